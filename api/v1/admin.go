@@ -1,10 +1,9 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
-
-	"gopkg.in/mgo.v2/bson"
 )
 
 const (
@@ -25,7 +24,7 @@ func getPwd() (string, error) {
 }
 
 // the admin is a special guest with just username and password
-func createAdmin() error {
+func createAdmin(ctx context.Context) error {
 
 	pwd, err := getPwd()
 	if err != nil {
@@ -34,18 +33,23 @@ func createAdmin() error {
 	g := new(Guest)
 	g.UserName = adminUser
 	g.Password = pwd
+	g.Role = RoleAdmin
 
 	//Create user
-	return db.CreateGuest(g)
+	if err = db.CreateGuest(ctx, g); err != nil {
+		return err
+	}
+	appendHistory(ctx, db, historySystem, historyCreate, Guest{}, *g)
+	return nil
 }
 
-func secureAdmin() error {
+func secureAdmin(ctx context.Context) error {
 	// check if the admin exists
-	ad, _ := db.ReadGuest(bson.M{"user_name": adminUser})
+	ad, _ := db.ReadGuest(ctx, adminUser)
 
 	if ad.UserName == adminUser {
 		return nil
 	}
 	// It does not exist: create it
-	return createAdmin()
+	return createAdmin(ctx)
 }
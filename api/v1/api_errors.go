@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//ErrorCode tells the errors apart: the codes are stable, the messages may change
+type ErrorCode string
+
+// Codes of the errors
+const (
+	// the body is not the JSON expected
+	CodeInvalidBody ErrorCode = "invalid_body"
+	// the request is refused as a whole
+	CodeInvalidRequest ErrorCode = "invalid_request"
+	// the field of the error is refused
+	CodeInvalidField ErrorCode = "invalid_field"
+	// the bearer token is missing or invalid
+	CodeUnauthorized ErrorCode = "unauthorized"
+	// the token expired: refresh it
+	CodeTokenExpired ErrorCode = "token_expired"
+	// the token was revoked: log in again
+	CodeTokenRevoked  ErrorCode = "token_revoked"
+	CodeWrongPassword ErrorCode = "wrong_password"
+	CodeUnknownUser   ErrorCode = "unknown_user"
+	// the token doesn't grant the request
+	CodeForbidden ErrorCode = "forbidden"
+	CodeNotFound  ErrorCode = "not_found"
+	// the route exists with other methods
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeUserNameTaken    ErrorCode = "user_name_taken"
+	CodeEventFull        ErrorCode = "event_full"
+	CodeChangeDecided    ErrorCode = "change_decided"
+	CodeReminderDone     ErrorCode = "reminder_done"
+	CodeRSVPClosed       ErrorCode = "rsvp_closed"
+	// too many failed logins: retry after the Retry-After header
+	CodeLoginBlocked ErrorCode = "login_blocked"
+	// the guest has no email
+	CodeNoEmail ErrorCode = "no_email"
+	// no SMTP relay, or no site URL, is configured
+	CodeNotConfigured ErrorCode = "not_configured"
+	// the database doesn't answer: retry later
+	CodeUnavailable ErrorCode = "unavailable"
+	CodeInternal    ErrorCode = "internal"
+)
+
+//APIError is an error answered to the client, in an ErrorEnvelope
+type APIError struct {
+	Status  int       `json:"-"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// Field is the field of the body refused, if any: the first one of Errors
+	Field string `json:"field,omitempty"`
+	// Errors are the fields refused, one error each
+	Errors []FieldError `json:"errors,omitempty"`
+	// RequestID is also in the X-Request-ID header, and in the logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+//FieldError is the error of a field of the body
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+//ErrorEnvelope is the body of every error response
+type ErrorEnvelope struct {
+	Error *APIError `json:"error"`
+}
+
+// newAPIError returns an error answered with status
+func newAPIError(status int, code ErrorCode, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// fieldError refuses a field of the body
+func fieldError(field string, err error) *APIError {
+	e := newAPIError(http.StatusBadRequest, CodeInvalidField, err.Error())
+	e.Field = field
+	return e
+}
+
+// badRequest refuses the request for err: the errors of the decoding of the
+// body are told apart from the other ones. The errors mapped by toAPIError keep their status
+func badRequest(err error) *APIError {
+	if e := toAPIError(err); e.Status != http.StatusInternalServerError {
+		return &e
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	// the decoder has no type for the unknown fields
+	if name := strings.TrimPrefix(err.Error(), "json: unknown field "); name != err.Error() {
+		e := newAPIError(http.StatusBadRequest, CodeInvalidField, "Unknown field "+name)
+		e.Field = strings.Trim(name, `"`)
+		return e
+	}
+	switch {
+	case errors.As(err, &typeErr):
+		e := newAPIError(http.StatusBadRequest, CodeInvalidBody, err.Error())
+		e.Field = typeErr.Field
+		return e
+	case errors.As(err, &syntaxErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return newAPIError(http.StatusBadRequest, CodeInvalidBody, "Invalid JSON body: "+err.Error())
+	}
+	return newAPIError(http.StatusBadRequest, CodeInvalidRequest, err.Error())
+}
+
+// unauthorized refuses the token of the request
+func unauthorized(message string) *APIError {
+	return newAPIError(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+// forbidden refuses a request the token doesn't grant
+func forbidden(message string) *APIError {
+	return newAPIError(http.StatusForbidden, CodeForbidden, message)
+}
+
+// unknownUser tells a user name not found from the other not found
+func unknownUser(err error) error {
+	if err != ErrNotFound {
+		return err
+	}
+	e := newAPIError(http.StatusNotFound, CodeUnknownUser, "Unknown user")
+	e.Field = "user_name"
+	return e
+}
+
+// toAPIError maps the errors of the store, of the auth and of the messages.
+// The unknown ones are internal: their text is logged, not answered
+func toAPIError(err error) APIError {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return *ae
+	}
+	mapped := func(status int, code ErrorCode) APIError {
+		return APIError{Status: status, Code: code, Message: err.Error()}
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return mapped(http.StatusNotFound, CodeNotFound)
+	case errors.Is(err, ErrUnknownMessage):
+		return mapped(http.StatusNotFound, CodeNotFound)
+	case errors.Is(err, ErrUserNameTaken):
+		e := mapped(http.StatusConflict, CodeUserNameTaken)
+		e.Field = "user_name"
+		return e
+	case errors.Is(err, ErrEventFull):
+		return mapped(http.StatusConflict, CodeEventFull)
+	case errors.Is(err, ErrChangeDecided):
+		return mapped(http.StatusConflict, CodeChangeDecided)
+	case errors.Is(err, ErrReminderDone):
+		return mapped(http.StatusConflict, CodeReminderDone)
+	case errors.Is(err, ErrRSVPClosed):
+		return mapped(http.StatusLocked, CodeRSVPClosed)
+	case errors.Is(err, ErrLoginBlocked):
+		return mapped(http.StatusTooManyRequests, CodeLoginBlocked)
+	case errors.Is(err, ErrTokenRevoked):
+		return mapped(http.StatusUnauthorized, CodeTokenRevoked)
+	case errors.Is(err, ErrWrongPassword):
+		e := mapped(http.StatusUnauthorized, CodeWrongPassword)
+		e.Field = "password"
+		return e
+	case errors.Is(err, ErrInvalidUserName):
+		e := mapped(http.StatusBadRequest, CodeInvalidField)
+		e.Field = "user_name"
+		return e
+	case errors.Is(err, ErrNoEmail):
+		e := mapped(http.StatusBadRequest, CodeNoEmail)
+		e.Field = "email"
+		return e
+	case errors.Is(err, ErrLinkRole):
+		return mapped(http.StatusBadRequest, CodeInvalidRequest)
+	case errors.Is(err, context.DeadlineExceeded), mongo.IsTimeout(err), mongo.IsNetworkError(err):
+		return APIError{Status: http.StatusServiceUnavailable, Code: CodeUnavailable, Message: "The database is not available, retry later"}
+	}
+	return APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "Internal error"}
+}
+
+// fail answers err in the error envelope, with the ID of the request
+func (hb *HandlerBridge) fail(w http.ResponseWriter, r *http.Request, err error) {
+	e := toAPIError(err)
+	e.RequestID = requestID(r)
+	if e.Status >= http.StatusInternalServerError {
+		log.Printf("Request %s %s %s failed: %s", e.RequestID, r.Method, r.URL.Path, err)
+	}
+	hb.rnd.JSON(w, e.Status, ErrorEnvelope{Error: &e})
+}
+
+// requestIDKey is the context key of the ID of the request
+type requestIDKey struct{}
+
+// validRequestID accepts the IDs set by nginx, or by a client, that are safe to log
+var validRequestID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// withRequestID gives an ID to the request, the one of the X-Request-ID
+// header when set, and sends it back in the response header
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID given by withRequestID
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
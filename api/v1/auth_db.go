@@ -1,83 +1,128 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"net/http"
+	"time"
 
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// Numeric code for each API
+// Kinds of token stored in the TOKEN collection
 const (
-	APIReadGuest   = 2
-	APIUpdateGuest = 3
-	APICreateGuest = 5
-	APIReadAll     = 7
+	// the jwt sent as bearer to the API
+	authKindAccess = "access"
+	// the opaque token exchanged on /auth/refresh for a new pair
+	authKindRefresh = "refresh"
+	// the signed invitation link exchanged on /auth/link for a new pair
+	authKindLink = "link"
 )
 
-func checkValidityAuthCode(authCode int) bool {
-	if authCode == 1 || authCode == 0 {
-		return false
-	}
-	return (authCode%APIReadGuest) == 0 || (authCode%APICreateGuest) == 0 || (authCode%APIUpdateGuest) == 0 || (authCode%APIReadAll) == 0
-}
+// Lifetime of the issued tokens
+const (
+	accessTokenTTL  = time.Hour
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
 
-// checkAuthCode check the API code against the
-// auth code stored in the db
-func checkAuthCode(APICode, authCodeStored int) bool {
-	// If == 0 is trivial. If > stands, for sure the user is not authorized
-	// Example: a typical user has C+U rights ==> value 6; if the API is the ReadAll then APICode is 7
-	// and 7 > 6. The authorization is denied
-	if APICode == 0 || APICode > authCodeStored {
-		return false
-	}
-	return authCodeStored%APICode == 0
-}
+//ErrTokenRevoked is returned when a revoked token is used, or revoked again
+var ErrTokenRevoked = errors.New("Token has been revoked")
 
-//Auth is the authorization structure. In a less primitive environment
-//we should bind it to an expiration date as well
+//Auth is the authorization structure, bound to an expiration date.
+//Valid is set to false when the token is revoked
 type Auth struct {
-	ID       bson.ObjectId `bson:"_id"`
-	Token    string        `bson:"token"`
-	Valid    bool          `bson:"valid"`
-	User     string        `bson:"user"`
-	AuthCode int           `bson:"auth_code"`
+	ID        primitive.ObjectID `bson:"_id"`
+	Token     string             `bson:"token"`
+	Valid     bool               `bson:"valid"`
+	User      string             `bson:"user"`
+	Role      Role               `bson:"role"`
+	Kind      string             `bson:"kind"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	// SingleUse tokens are revoked on their first use
+	SingleUse bool `bson:"single_use"`
 }
 
-//InsertAuth insert an auth object in the db
-func (db *DataBridge) InsertAuth(token, user string, authCode int) error {
-	if token == "" {
+// validateAuth checks the fields of an Auth to be inserted
+func validateAuth(a *Auth) error {
+	if a.Token == "" {
 		return errors.New("No token provided")
 	}
 
-	if user == "" {
+	if a.User == "" {
 		return errors.New("No user provided")
 	}
 
-	if !checkValidityAuthCode(authCode) {
-		return errors.New("AuthCode not valid")
+	if !validRole(a.Role) {
+		return errors.New("Role not valid")
 	}
 
+	if a.Kind != authKindAccess && a.Kind != authKindRefresh && a.Kind != authKindLink {
+		return errors.New("Token kind not valid")
+	}
+	return nil
+}
+
+// newAuth validates the parameters and build a new valid Auth
+func newAuth(token, user string, role Role, kind string, expiresAt time.Time) (Auth, error) {
 	a := Auth{
-		ID:       bson.NewObjectId(),
-		Token:    token,
-		Valid:    true,
-		User:     user,
-		AuthCode: authCode,
+		ID:        primitive.NewObjectID(),
+		Token:     token,
+		Valid:     true,
+		User:      user,
+		Role:      role,
+		Kind:      kind,
+		ExpiresAt: expiresAt,
 	}
+	return a, validateAuth(&a)
+}
 
-	tc, err := db.tokenColl()
+// checkAuthUsable refuses revoked and expired tokens, or tokens of the wrong kind.
+// Tokens issued before the expiration was introduced have no date and are refused
+func checkAuthUsable(a Auth, kind string) error {
+	if !a.Valid {
+		return ErrTokenRevoked
+	}
+	if a.ExpiresAt.IsZero() || time.Now().After(a.ExpiresAt) {
+		return newAPIError(http.StatusUnauthorized, CodeTokenExpired, "Token expired")
+	}
+	if a.Kind != kind {
+		return unauthorized("Wrong kind of token")
+	}
+	return nil
+}
 
-	if err != nil {
+// checkAuthUpdate verifies that an update does not touch the immutable fields
+func checkAuthUpdate(stored Auth, auth *Auth) error {
+	if stored.ID.Hex() != auth.ID.Hex() {
+		return errors.New("Changing id is not possible")
+	}
+	if stored.User != auth.User {
+		return errors.New("Changing user is not possible")
+	}
+	return nil
+}
+
+//InsertAuth insert an auth object in the db
+func (db *DataBridge) InsertAuth(ctx context.Context, a Auth) error {
+	if err := validateAuth(&a); err != nil {
 		return err
 	}
 
+	tc := db.tokenColl()
+
 	//check if it exists already
-	err = tc.Find(bson.M{"token": token}).One(&a)
-	if err == nil {
+	n, err := tc.CountDocuments(ctx, bson.M{"token": a.Token})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
 		return nil
 	}
 
-	if err := tc.Insert(&a); err != nil {
+	// inserted meanwhile: the unique index refuses it
+	if _, err := tc.InsertOne(ctx, &a); err != nil && !mongo.IsDuplicateKeyError(err) {
 		return err
 	}
 
@@ -86,47 +131,98 @@ func (db *DataBridge) InsertAuth(token, user string, authCode int) error {
 }
 
 //ReadAuth : read a token from the db collection and return the Auth
-func (db *DataBridge) ReadAuth(token string) (Auth, error) {
+func (db *DataBridge) ReadAuth(ctx context.Context, token string) (Auth, error) {
 	var a Auth
 	if token == "" {
 		return a, errors.New("No token provided")
 	}
 
-	tc, err := db.tokenColl()
-
-	if err != nil {
-		return a, err
-	}
-	err = tc.Find(bson.M{"token": token}).One(&a)
-	return a, err
+	err := db.tokenColl().FindOne(ctx, bson.M{"token": token}).Decode(&a)
+	return a, mongoErr(err)
 
 }
 
 //UpdateAuth allow a selected update of an auth
-func (db *DataBridge) UpdateAuth(auth *Auth) error {
+func (db *DataBridge) UpdateAuth(ctx context.Context, auth *Auth) error {
 	//Check the existence of the auth to update
-	stored, err := db.ReadAuth(auth.Token)
+	stored, err := db.ReadAuth(ctx, auth.Token)
 	if err != nil {
 		return err
 	}
 
 	//Check that we are not changing something letal
-	if stored.ID.Hex() != auth.ID.Hex() {
-		return errors.New("Changing id is not possible")
+	if err = checkAuthUpdate(stored, auth); err != nil {
+		return err
 	}
-	if stored.User != auth.User {
-		return errors.New("Changing user is not possible")
+
+	// a token is revoked only once: of two concurrent uses, one fails
+	filter := bson.M{"_id": auth.ID}
+	if !auth.Valid {
+		filter["valid"] = true
+	}
+	err = updateErr(db.tokenColl().UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+		"valid": auth.Valid,
+		"role":  auth.Role,
+	},
+	}))
+	if err == ErrNotFound && !auth.Valid {
+		return ErrTokenRevoked
 	}
+	return err
 
-	tc, err := db.tokenColl()
+}
 
-	if err != nil {
+//RevokeUserAuths revokes every token of a user
+func (db *DataBridge) RevokeUserAuths(ctx context.Context, user string) error {
+	_, err := db.tokenColl().UpdateMany(ctx, bson.M{"user": user, "valid": true},
+		bson.M{"$set": bson.M{"valid": false}})
+	return err
+}
+
+//RevokeUserAuthKind revokes the tokens of a kind of a user
+func (db *DataBridge) RevokeUserAuthKind(ctx context.Context, user, kind string) error {
+	_, err := db.tokenColl().UpdateMany(ctx, bson.M{"user": user, "kind": kind, "valid": true},
+		bson.M{"$set": bson.M{"valid": false}})
+	return err
+}
+
+//migrateRoles gives a role to the tokens and the users stored with the
+//prime auth codes, before the roles existed
+func (db *DataBridge) migrateRoles(ctx context.Context) error {
+	noRole := bson.M{"role": bson.M{"$exists": false}}
+
+	// The admin is the only user with a role other than guest
+	if _, err := db.guestColl().UpdateMany(ctx,
+		bson.M{"role": bson.M{"$exists": false}, "user_name": adminUser},
+		bson.M{"$set": bson.M{"role": RoleAdmin}}); err != nil {
+		return err
+	}
+	if _, err := db.guestColl().UpdateMany(ctx, noRole,
+		bson.M{"$set": bson.M{"role": RoleGuest}}); err != nil {
 		return err
 	}
-	return tc.UpdateId(auth.ID, bson.M{"$set": bson.M{
-		"valid":     auth.Valid,
-		"auth_code": auth.AuthCode,
-	},
-	})
 
+	// Tokens: the role follows from the auth code
+	cur, err := db.tokenColl().Find(ctx, noRole)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var legacy struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			AuthCode int                `bson:"auth_code"`
+		}
+		if err = cur.Decode(&legacy); err != nil {
+			return err
+		}
+		if _, err = db.tokenColl().UpdateByID(ctx, legacy.ID, bson.M{
+			"$set":   bson.M{"role": roleFromAuthCode(legacy.AuthCode)},
+			"$unset": bson.M{"auth_code": ""},
+		}); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+//RefreshRequest is the body of the refresh and logout calls
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// randomToken returns an url safe random string
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueTokens creates a new access and refresh pair with the rights of usID.Role,
+// stores it and sets it in the User Identification Structure
+func (hb *HandlerBridge) issueTokens(ctx context.Context, usID *UserIdentification) error {
+	now := time.Now()
+	if err := createToken(usID, now.Add(accessTokenTTL)); err != nil {
+		return err
+	}
+	access, err := newAuth(usID.JwtToken, usID.UserName, usID.Role, authKindAccess, now.Add(accessTokenTTL))
+	if err != nil {
+		return err
+	}
+	if err = hb.db.InsertAuth(ctx, access); err != nil {
+		return err
+	}
+
+	if usID.RefreshToken, err = randomToken(); err != nil {
+		return err
+	}
+	refresh, err := newAuth(usID.RefreshToken, usID.UserName, usID.Role, authKindRefresh, now.Add(refreshTokenTTL))
+	if err != nil {
+		return err
+	}
+	return hb.db.InsertAuth(ctx, refresh)
+}
+
+// requestAuth returns the stored Auth of the bearer token of the request
+func requestAuth(r *http.Request, db Store) (Auth, error) {
+	_, tokenString, err := extractToken(r)
+	if err != nil {
+		return Auth{}, err
+	}
+	a, err := db.ReadAuth(r.Context(), tokenString)
+	if err == ErrNotFound {
+		return a, unauthorized("Unknown token")
+	}
+	if err != nil {
+		return a, err
+	}
+	return a, checkAuthUsable(a, authKindAccess)
+}
+
+// revoke flips the Valid flag of a stored token
+func (hb *HandlerBridge) revoke(ctx context.Context, a Auth) error {
+	a.Valid = false
+	return hb.db.UpdateAuth(ctx, &a)
+}
+
+//RefreshAuth exchanges a refresh token for a new pair. The refresh token
+//is rotated: the one provided can't be used again
+func (hb *HandlerBridge) RefreshAuth(w http.ResponseWriter, r *http.Request) {
+	var rr RefreshRequest
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&rr); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	stored, err := hb.db.ReadAuth(r.Context(), rr.RefreshToken)
+	if err == ErrNotFound {
+		err = unauthorized("Invalid refresh token")
+	}
+	if err == nil {
+		err = checkAuthUsable(stored, authKindRefresh)
+	}
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	g, err := hb.db.ReadGuest(r.Context(), stored.User)
+	if err == ErrNotFound {
+		err = unauthorized("The user of the token doesn't exist anymore")
+	}
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	// Revoke before issuing: a failure leaves the guest logged out, never with two valid tokens
+	if err = hb.revoke(r.Context(), stored); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	// the role is read again: a change applies at the next refresh
+	usID := &UserIdentification{
+		UserName: g.UserName,
+		ID:       g.ID.Hex(),
+		Role:     roleOf(g),
+	}
+	if err = hb.issueTokens(r.Context(), usID); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	hb.rnd.JSON(w, http.StatusOK, usID)
+}
+
+//Logout revokes the bearer token and, when provided in the body,
+//the refresh token of the same user
+func (hb *HandlerBridge) Logout(w http.ResponseWriter, r *http.Request) {
+	access, err := requestAuth(r, hb.db)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	// the body is optional
+	var rr RefreshRequest
+	defer r.Body.Close()
+	json.NewDecoder(r.Body).Decode(&rr)
+
+	if err = hb.revoke(r.Context(), access); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	if rr.RefreshToken != "" {
+		refresh, err := hb.db.ReadAuth(r.Context(), rr.RefreshToken)
+		if err == nil && refresh.Valid && refresh.Kind == authKindRefresh && refresh.User == access.User {
+			if err = hb.revoke(r.Context(), refresh); err != nil {
+				hb.fail(w, r, err)
+				return
+			}
+		}
+	}
+
+	if g, err := hb.db.ReadGuest(r.Context(), access.User); err == nil {
+		appendHistory(r.Context(), hb.db, access.User, historyLogout, g, g)
+	}
+	hb.rnd.JSON(w, http.StatusOK, "Logged out")
+}
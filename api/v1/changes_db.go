@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Status of a change request
+const (
+	changePending  = "pending"
+	changeApproved = "approved"
+	changeRejected = "rejected"
+)
+
+//ErrChangeDecided is returned when a change request was already approved or rejected
+var ErrChangeDecided = errors.New("Change request already decided")
+
+//RSVPAnswer are the fields of the RSVP a guest answers
+type RSVPAnswer struct {
+	Confirmed         bool     `json:"confirmed" bson:"confirmed"`
+	NeedsAccomodation bool     `json:"needs_accomodation" bson:"needs_accomodation"`
+	NeedsPassage      bool     `json:"needs_passage" bson:"needs_passage"`
+	FoodRequirements  string   `json:"food_requirements" bson:"food_requirements"`
+	Modification      string   `json:"modification" bson:"modification"`
+	Members           []Member `json:"members" bson:"members"`
+}
+
+// guest is the answer in the shape of a PUT /guests/{id}
+func (a RSVPAnswer) guest() Guest {
+	return Guest{
+		Confirmed:         a.Confirmed,
+		NeedsAccomodation: a.NeedsAccomodation,
+		NeedsPassage:      a.NeedsPassage,
+		FoodRequirements:  a.FoodRequirements,
+		Modification:      a.Modification,
+		Members:           a.Members,
+	}
+}
+
+//ChangeRequest is an RSVP sent after the deadline, applied once an admin approves it.
+//The requests are kept after the decision: they are the trail of the late changes
+type ChangeRequest struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	GuestID   primitive.ObjectID `json:"guest_id" bson:"guest_id"`
+	UserName  string             `json:"user_name" bson:"user_name"`
+	RSVP      RSVPAnswer         `json:"rsvp" bson:"rsvp"`
+	Reason    string             `json:"reason" bson:"reason"`
+	Status    string             `json:"status" bson:"status"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	DecidedAt *time.Time         `json:"decided_at,omitempty" bson:"decided_at,omitempty"`
+	// DecidedBy is the user name of the admin who approved or rejected the request
+	DecidedBy string `json:"decided_by,omitempty" bson:"decided_by"`
+	Comment   string `json:"comment,omitempty" bson:"comment"`
+}
+
+// prepareChange set a new id and the pending status of a request to be created
+func prepareChange(c *ChangeRequest) {
+	c.ID = primitive.NewObjectID()
+	c.Status = changePending
+	c.CreatedAt = time.Now()
+	c.DecidedAt = nil
+	c.DecidedBy = ""
+	c.Comment = ""
+	if c.RSVP.Members == nil {
+		c.RSVP.Members = []Member{}
+	}
+}
+
+// validChangeStatus accepts the statuses and the empty filter
+func validChangeStatus(status string) bool {
+	switch status {
+	case "", changePending, changeApproved, changeRejected:
+		return true
+	}
+	return false
+}
+
+func (db *DataBridge) changeColl() *mongo.Collection {
+	return db.client.Database(dbName).Collection(changeCollection)
+}
+
+//CreateChange store a new pending change request
+func (db *DataBridge) CreateChange(ctx context.Context, c *ChangeRequest) error {
+	prepareChange(c)
+	_, err := db.changeColl().InsertOne(ctx, c)
+	return err
+}
+
+//ReadChange fetch a change request by id
+func (db *DataBridge) ReadChange(ctx context.Context, id primitive.ObjectID) (ChangeRequest, error) {
+	var c ChangeRequest
+
+	err := db.changeColl().FindOne(ctx, bson.M{"_id": id}).Decode(&c)
+	return c, mongoErr(err)
+}
+
+//ReadChanges fetch the change requests with the status, every one when empty
+func (db *DataBridge) ReadChanges(ctx context.Context, status string) ([]ChangeRequest, error) {
+	cs := []ChangeRequest{}
+
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	cur, err := db.changeColl().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return cs, err
+	}
+	err = cur.All(ctx, &cs)
+	return cs, err
+}
+
+//DecideChange records the decision on a pending change request
+func (db *DataBridge) DecideChange(ctx context.Context, c *ChangeRequest) error {
+	err := updateErr(db.changeColl().UpdateOne(ctx, bson.M{"_id": c.ID, "status": changePending}, bson.M{"$set": bson.M{
+		"status":     c.Status,
+		"decided_at": c.DecidedAt,
+		"decided_by": c.DecidedBy,
+		"comment":    c.Comment,
+	}}))
+	if err == ErrNotFound {
+		return ErrChangeDecided
+	}
+	return err
+}
+
+//ReopenChange puts back to pending a request decided with status
+func (db *DataBridge) ReopenChange(ctx context.Context, id primitive.ObjectID, status string) error {
+	return updateErr(db.changeColl().UpdateOne(ctx, bson.M{"_id": id, "status": status}, bson.M{
+		"$set":   bson.M{"status": changePending, "decided_by": "", "comment": ""},
+		"$unset": bson.M{"decided_at": ""},
+	}))
+}
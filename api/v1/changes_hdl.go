@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//ChangeDecision is the optional body of the approval or rejection of a change request
+type ChangeDecision struct {
+	Comment string `json:"comment"`
+}
+
+//RequestChange stores the RSVP a guest wants once the deadline has passed:
+//nothing changes until an admin approves it
+func (hb *HandlerBridge) RequestChange(w http.ResponseWriter, r *http.Request) {
+	id, err := guestIDFromVars(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	var c ChangeRequest
+	defer r.Body.Close()
+
+	if err = decodeStrict(r.Body, &c); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	g, err := hb.db.ReadGuestByID(r.Context(), id)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	if err = validateChange(c, g); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	c.GuestID = g.ID
+	c.UserName = g.UserName
+	if err = hb.db.CreateChange(r.Context(), &c); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyChangeRequested, g, g)
+	hb.rnd.JSON(w, http.StatusOK, c)
+}
+
+//GetChanges retrieve the change requests by creation time; ?status=pending,
+//approved or rejected filters them
+func (hb *HandlerBridge) GetChanges(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if !validChangeStatus(status) {
+		hb.fail(w, r, fieldError("status", errors.New("Invalid status "+status)))
+		return
+	}
+
+	cs, err := hb.db.ReadChanges(r.Context(), status)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, cs)
+}
+
+// readDecision parses the id of the change request and the optional comment
+func readDecision(r *http.Request) (primitive.ObjectID, ChangeDecision, error) {
+	var d ChangeDecision
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		return id, d, err
+	}
+
+	defer r.Body.Close()
+	// the comment is optional, so is the body
+	if err = json.NewDecoder(r.Body).Decode(&d); err != nil && err != io.EOF {
+		return id, d, err
+	}
+	return id, d, nil
+}
+
+// pendingChange returns the change request decided by the admin making the request
+func (hb *HandlerBridge) pendingChange(r *http.Request, id primitive.ObjectID, d ChangeDecision, status string) (ChangeRequest, error) {
+	c, err := hb.db.ReadChange(r.Context(), id)
+	if err != nil {
+		return c, err
+	}
+	if c.Status != changePending {
+		return c, ErrChangeDecided
+	}
+	a, err := requestAuth(r, hb.db)
+	if err != nil {
+		return c, err
+	}
+
+	now := time.Now()
+	c.Status = status
+	c.DecidedAt = &now
+	c.DecidedBy = a.User
+	c.Comment = d.Comment
+	return c, nil
+}
+
+//ApproveChange applies the RSVP of a pending change request to the guest
+func (hb *HandlerBridge) ApproveChange(w http.ResponseWriter, r *http.Request) {
+	id, d, err := readDecision(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	c, err := hb.pendingChange(r, id, d, changeApproved)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	g, err := hb.db.ReadGuestByID(r.Context(), c.GuestID)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	// the household may have changed since the request
+	if err = validateChange(c, g); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	// the request is claimed before the guest changes: of two concurrent
+	// decisions, only one is carried out
+	if err = hb.db.DecideChange(r.Context(), &c); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	before := g.clone()
+	if err = hb.applyRSVP(r, &g, c.RSVP.guest()); err != nil {
+		if rerr := hb.db.ReopenChange(r.Context(), c.ID, c.Status); rerr != nil {
+			log.Printf("Change request %s approved but not applied: %s", c.ID.Hex(), rerr)
+		}
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyChangeApproved, before, g)
+	hb.sendConfirmation(r, g)
+	hb.rnd.JSON(w, http.StatusOK, c)
+}
+
+//RejectChange closes a pending change request, leaving the guest as it is
+func (hb *HandlerBridge) RejectChange(w http.ResponseWriter, r *http.Request) {
+	id, d, err := readDecision(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	c, err := hb.pendingChange(r, id, d, changeRejected)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	if err = hb.db.DecideChange(r.Context(), &c); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	if g, err := hb.db.ReadGuestByID(r.Context(), c.GuestID); err == nil {
+		hb.record(r, historyChangeRejected, g, g)
+	}
+	hb.rnd.JSON(w, http.StatusOK, c)
+}
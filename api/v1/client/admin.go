@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//GetStats returns the RSVP numbers
+func (c *Client) GetStats(ctx context.Context) (GuestStats, error) {
+	var s GuestStats
+	_, err := c.do(ctx, http.MethodGet, "/stats", nil, nil, &s)
+	return s, err
+}
+
+//ListEvents returns the events of the wedding
+func (c *Client) ListEvents(ctx context.Context) ([]Event, error) {
+	var es []Event
+	_, err := c.do(ctx, http.MethodGet, "/events", nil, nil, &es)
+	return es, err
+}
+
+//CreateEvent creates an event
+func (c *Client) CreateEvent(ctx context.Context, e Event) (Event, error) {
+	var created Event
+	_, err := c.do(ctx, http.MethodPost, "/events", nil, e, &created)
+	return created, err
+}
+
+//UpdateEvent changes an event
+func (c *Client) UpdateEvent(ctx context.Context, e Event) (Event, error) {
+	var updated Event
+	_, err := c.do(ctx, http.MethodPut, "/events/"+e.ID.Hex(), nil, e, &updated)
+	return updated, err
+}
+
+//DeleteEvent deletes an event
+func (c *Client) DeleteEvent(ctx context.Context, id primitive.ObjectID) error {
+	_, err := c.do(ctx, http.MethodDelete, "/events/"+id.Hex(), nil, nil, nil)
+	return err
+}
+
+//GetHistory returns the changes of the guests, and how many match the
+//query: guest_id, actor, action, since, until, limit and offset
+func (c *Client) GetHistory(ctx context.Context, query url.Values) ([]HistoryEntry, int, error) {
+	var hs []HistoryEntry
+	resp, err := c.do(ctx, http.MethodGet, "/history", query, nil, &hs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hs, total(resp), nil
+}
+
+// The kinds of the emails of a guest
+const (
+	MessageInvitation   = "invitation"
+	MessageConfirmation = "confirmation"
+	MessageReminder     = "reminder"
+)
+
+//PreviewMessage renders an email of a guest without sending it
+func (c *Client) PreviewMessage(ctx context.Context, id primitive.ObjectID, kind string) (Message, error) {
+	var m Message
+	_, err := c.do(ctx, http.MethodGet, guestPath(id, "/messages/"+url.PathEscape(kind)), nil, nil, &m)
+	return m, err
+}
+
+//InvitationOptions choose how an invitation lets the guest log in: by default
+//with its username, the password being kept
+type InvitationOptions struct {
+	// Link sends a new invitation link
+	Link bool
+	// ResetPassword sends a new password, revoking the tokens of the old one
+	ResetPassword bool
+}
+
+//SendInvitation emails the invitation to a guest
+func (c *Client) SendInvitation(ctx context.Context, id primitive.ObjectID, opts InvitationOptions) error {
+	query := url.Values{}
+	if opts.Link {
+		query.Set("link", "true")
+	}
+	if opts.ResetPassword {
+		query.Set("reset_password", "true")
+	}
+	_, err := c.do(ctx, http.MethodPost, guestPath(id, "/invitation"), query, nil, nil)
+	return err
+}
+
+//SendReminder emails a reminder to answer the RSVP to a guest
+func (c *Client) SendReminder(ctx context.Context, id primitive.ObjectID) error {
+	_, err := c.do(ctx, http.MethodPost, guestPath(id, "/reminder"), nil, nil, nil)
+	return err
+}
+
+//CreateGuestLink generates an invitation link of a guest
+func (c *Client) CreateGuestLink(ctx context.Context, id primitive.ObjectID, lr LinkRequest) (GuestLink, error) {
+	var link GuestLink
+	_, err := c.do(ctx, http.MethodPost, guestPath(id, "/link"), nil, lr, &link)
+	return link, err
+}
+
+//RevokeGuestLinks revokes the invitation links of a guest
+func (c *Client) RevokeGuestLinks(ctx context.Context, id primitive.ObjectID) error {
+	_, err := c.do(ctx, http.MethodDelete, guestPath(id, "/link"), nil, nil, nil)
+	return err
+}
+
+//ListLockouts returns the user names and the addresses with failed logins
+func (c *Client) ListLockouts(ctx context.Context) ([]LoginBlock, error) {
+	var bs []LoginBlock
+	_, err := c.do(ctx, http.MethodGet, "/lockouts", nil, nil, &bs)
+	return bs, err
+}
+
+//Unlock forgets the failed logins of a user name (kind "user") or of an
+//address (kind "ip")
+func (c *Client) Unlock(ctx context.Context, kind, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/lockouts/"+url.PathEscape(kind)+"/"+url.PathEscape(key), nil, nil, nil)
+	return err
+}
+
+//ListReminders returns the reminder campaigns
+func (c *Client) ListReminders(ctx context.Context) ([]Reminder, error) {
+	var rms []Reminder
+	_, err := c.do(ctx, http.MethodGet, "/reminders", nil, nil, &rms)
+	return rms, err
+}
+
+//ScheduleReminder schedules a campaign: at sendAt the guests who didn't
+//answer or never logged in are reminded
+func (c *Client) ScheduleReminder(ctx context.Context, sendAt time.Time) (Reminder, error) {
+	var rm Reminder
+	_, err := c.do(ctx, http.MethodPost, "/reminders", nil, Reminder{SendAt: sendAt}, &rm)
+	return rm, err
+}
+
+//DeleteReminder cancels a campaign not done yet
+func (c *Client) DeleteReminder(ctx context.Context, id primitive.ObjectID) error {
+	_, err := c.do(ctx, http.MethodDelete, "/reminders/"+id.Hex(), nil, nil, nil)
+	return err
+}
+
+//PreviewReminder tells who a campaign would remind now
+func (c *Client) PreviewReminder(ctx context.Context, id primitive.ObjectID) (ReminderPreview, error) {
+	var p ReminderPreview
+	_, err := c.do(ctx, http.MethodGet, "/reminders/"+id.Hex()+"/preview", nil, nil, &p)
+	return p, err
+}
+
+//ListReminderSends returns the reminders sent by a campaign
+func (c *Client) ListReminderSends(ctx context.Context, id primitive.ObjectID) ([]ReminderSend, error) {
+	var ss []ReminderSend
+	_, err := c.do(ctx, http.MethodGet, "/reminders/"+id.Hex()+"/sends", nil, nil, &ss)
+	return ss, err
+}
+
+//ListChanges returns the change requests with status, all of them when empty
+func (c *Client) ListChanges(ctx context.Context, status string) ([]ChangeRequest, error) {
+	var query url.Values
+	if status != "" {
+		query = url.Values{"status": {status}}
+	}
+	var cs []ChangeRequest
+	_, err := c.do(ctx, http.MethodGet, "/changes", query, nil, &cs)
+	return cs, err
+}
+
+//ApproveChange applies a change request to the RSVP of its guest
+func (c *Client) ApproveChange(ctx context.Context, id primitive.ObjectID, comment string) (ChangeRequest, error) {
+	var cr ChangeRequest
+	_, err := c.do(ctx, http.MethodPost, "/changes/"+id.Hex()+"/approve", nil, ChangeDecision{Comment: comment}, &cr)
+	return cr, err
+}
+
+//RejectChange rejects a change request
+func (c *Client) RejectChange(ctx context.Context, id primitive.ObjectID, comment string) (ChangeRequest, error) {
+	var cr ChangeRequest
+	_, err := c.do(ctx, http.MethodPost, "/changes/"+id.Hex()+"/reject", nil, ChangeDecision{Comment: comment}, &cr)
+	return cr, err
+}
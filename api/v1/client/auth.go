@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// login stores the tokens answered to in on path
+func (c *Client) login(ctx context.Context, path string, in interface{}) (*UserIdentification, error) {
+	var id UserIdentification
+	if _, err := c.do(ctx, http.MethodPost, path, nil, in, &id); err != nil {
+		return nil, err
+	}
+	c.SetIdentity(&id)
+	return c.Identity(), nil
+}
+
+//Login logs in with a password: the following calls are made as the user.
+//Too many failures are refused with login_blocked, see Error.RetryAfter
+func (c *Client) Login(ctx context.Context, userName, password string) (*UserIdentification, error) {
+	return c.login(ctx, "/auth", UserAuth{UserName: userName, Password: password})
+}
+
+//LoginWithLink logs in with the token of an invitation link
+func (c *Client) LoginWithLink(ctx context.Context, token string) (*UserIdentification, error) {
+	return c.login(ctx, "/auth/link", LinkAuth{Token: token})
+}
+
+//Refresh exchanges the refresh token for a new pair. It is done by the
+//calls answered token_expired, there is no need to call it before
+func (c *Client) Refresh(ctx context.Context) (*UserIdentification, error) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	return c.refresh(ctx)
+}
+
+// refresh exchanges the refresh token; refreshMu must be held
+func (c *Client) refresh(ctx context.Context) (*UserIdentification, error) {
+	id := c.Identity()
+	if id == nil {
+		return nil, ErrNotLoggedIn
+	}
+	return c.login(ctx, "/auth/refresh", RefreshRequest{RefreshToken: id.RefreshToken})
+}
+
+//Logout revokes the tokens of the login and forgets them
+func (c *Client) Logout(ctx context.Context) error {
+	id := c.Identity()
+	if id == nil {
+		return ErrNotLoggedIn
+	}
+	_, err := c.do(ctx, http.MethodPost, "/auth/logout", nil, RefreshRequest{RefreshToken: id.RefreshToken}, nil)
+	if err == nil {
+		c.SetIdentity(nil)
+	}
+	return err
+}
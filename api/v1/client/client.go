@@ -0,0 +1,205 @@
+//Package client calls the API of the wedding site. A Client logs in once,
+//keeps its tokens and refreshes them when they expire:
+//
+//	var c client.Client
+//	c.Init("https://www.easywedcl.tk/api", nil)
+//	if _, err := c.Login(ctx, "admin", pwd); err != nil {
+//		...
+//	}
+//	guests, total, err := c.ListGuests(ctx, url.Values{"confirmed": {"true"}})
+//
+//The errors answered by the API are *Error, with the stable code of the error
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//ErrNotLoggedIn is returned by the calls needing the tokens of a login
+var ErrNotLoggedIn = errors.New("easywed: not logged in")
+
+//Client calls the API as the user of its last login
+type Client struct {
+	baseURL string
+	http    *http.Client
+
+	mu sync.Mutex
+	id *UserIdentification
+	// refreshMu serializes the refreshes: a refresh token is used once
+	refreshMu sync.Mutex
+}
+
+//Init sets the root of the API, as https://www.easywedcl.tk/api, and the
+//HTTP client sending the requests: http.DefaultClient when nil
+func (c *Client) Init(baseURL string, hc *http.Client) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	c.baseURL = strings.TrimSuffix(baseURL, "/")
+	c.http = hc
+}
+
+//Identity returns the tokens of the last login, nil if none
+func (c *Client) Identity() *UserIdentification {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.id == nil {
+		return nil
+	}
+	id := *c.id
+	return &id
+}
+
+//SetIdentity sets the tokens of a login done before, as by another Client
+func (c *Client) SetIdentity(id *UserIdentification) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.id = id
+}
+
+// token returns the bearer token of the requests
+func (c *Client) token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.id == nil {
+		return ""
+	}
+	return c.id.JwtToken
+}
+
+// request is a call to the API
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	// body is sent with its contentType, JSON when empty
+	body        []byte
+	contentType string
+}
+
+// jsonRequest encodes in as the body of the request, when not nil
+func jsonRequest(method, path string, query url.Values, in interface{}) (request, error) {
+	req := request{method: method, path: path, query: query}
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return req, err
+		}
+		req.body = b
+	}
+	return req, nil
+}
+
+// send sends req with the bearer token. An expired token is refreshed
+// once and the request sent again. The error responses are returned as *Error
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	token := c.token()
+	resp, err := c.sendOnce(ctx, req, token)
+	var e *Error
+	if errors.As(err, &e) && e.Code == CodeTokenExpired && !strings.HasPrefix(req.path, "/auth") {
+		if rerr := c.refreshExpired(ctx, token); rerr != nil {
+			return nil, err
+		}
+		resp, err = c.sendOnce(ctx, req, c.token())
+	}
+	return resp, err
+}
+
+// refreshExpired refreshes the tokens, unless the expired one was already
+// replaced by a concurrent call
+func (c *Client) refreshExpired(ctx context.Context, expired string) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	if c.token() != expired {
+		return nil
+	}
+	_, err := c.refresh(ctx)
+	return err
+}
+
+func (c *Client) sendOnce(ctx context.Context, req request, token string) (*http.Response, error) {
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if req.body != nil {
+		contentType := req.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		hreq.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusBadRequest {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, readError(resp)
+}
+
+// readError decodes the error envelope of resp
+func readError(resp *http.Response) error {
+	var env errorEnvelope
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil || env.Error == nil {
+		// not the API, as a proxy answering for it
+		return &Error{Status: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	}
+	env.Error.Status = resp.StatusCode
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		env.Error.RetryAfter, _ = strconv.Atoi(s)
+	}
+	return env.Error
+}
+
+// do sends in as JSON and decodes the JSON response in out, when not nil
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) (*http.Response, error) {
+	req, err := jsonRequest(method, path, query, in)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return resp, decode(resp, out)
+}
+
+// decode decodes the JSON body of resp in out, discarding it when out is nil
+func decode(resp *http.Response, out interface{}) error {
+	if out == nil {
+		_, err := io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// total reads the X-Total-Count header of the lists
+func total(resp *http.Response) int {
+	n, _ := strconv.Atoi(resp.Header.Get("X-Total-Count"))
+	return n
+}
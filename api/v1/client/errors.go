@@ -0,0 +1,64 @@
+package client
+
+import "fmt"
+
+//ErrorCode tells the errors apart: the codes are stable, the messages may change
+type ErrorCode string
+
+// Codes of the errors
+const (
+	CodeInvalidBody      ErrorCode = "invalid_body"
+	CodeInvalidRequest   ErrorCode = "invalid_request"
+	CodeInvalidField     ErrorCode = "invalid_field"
+	CodeUnauthorized     ErrorCode = "unauthorized"
+	CodeTokenExpired     ErrorCode = "token_expired"
+	CodeTokenRevoked     ErrorCode = "token_revoked"
+	CodeWrongPassword    ErrorCode = "wrong_password"
+	CodeUnknownUser      ErrorCode = "unknown_user"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeUserNameTaken    ErrorCode = "user_name_taken"
+	CodeEventFull        ErrorCode = "event_full"
+	CodeChangeDecided    ErrorCode = "change_decided"
+	CodeReminderDone     ErrorCode = "reminder_done"
+	CodeRSVPClosed       ErrorCode = "rsvp_closed"
+	CodeLoginBlocked     ErrorCode = "login_blocked"
+	CodeNoEmail          ErrorCode = "no_email"
+	CodeNotConfigured    ErrorCode = "not_configured"
+	CodeUnavailable      ErrorCode = "unavailable"
+	CodeInternal         ErrorCode = "internal"
+)
+
+//Error is an error answered by the API
+type Error struct {
+	// Status is the HTTP status of the response
+	Status  int       `json:"-"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// Field is the field of the body refused, if any: the first one of Errors
+	Field  string       `json:"field,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+	// RequestID is the one of the logs of the server
+	RequestID string `json:"request_id,omitempty"`
+	// RetryAfter is set on login_blocked, in seconds
+	RetryAfter int `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("easywed: %d %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("easywed: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+//FieldError is the error of a field of the body
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// errorEnvelope is the body of every error response
+type errorEnvelope struct {
+	Error *Error `json:"error"`
+}
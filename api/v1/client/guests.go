@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// guestPath is the path of a guest, followed by suffix
+func guestPath(id primitive.ObjectID, suffix string) string {
+	return "/guests/" + id.Hex() + suffix
+}
+
+//GetGuest reads a guest by user name: a guest can read only itself
+func (c *Client) GetGuest(ctx context.Context, userName string) (Guest, error) {
+	var g Guest
+	_, err := c.do(ctx, http.MethodGet, "/guests", url.Values{"user_name": {userName}}, nil, &g)
+	return g, err
+}
+
+//ListGuests returns a page of the guests and how many match the query.
+//The query filters on confirmed, needs_accomodation, needs_passage, country,
+//language and search, sorts with sort=field or sort=-field and pages with limit and offset
+func (c *Client) ListGuests(ctx context.Context, query url.Values) ([]Guest, int, error) {
+	var gs []Guest
+	resp, err := c.do(ctx, http.MethodGet, "/guests", query, nil, &gs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return gs, total(resp), nil
+}
+
+//CreateGuest creates a guest with its password
+func (c *Client) CreateGuest(ctx context.Context, g Guest) (Guest, error) {
+	var created Guest
+	_, err := c.do(ctx, http.MethodPost, "/guests", nil, g, &created)
+	return created, err
+}
+
+//UpdateGuest answers the RSVP of g, sent as a whole
+func (c *Client) UpdateGuest(ctx context.Context, g Guest) (Guest, error) {
+	var updated Guest
+	_, err := c.do(ctx, http.MethodPut, guestPath(g.ID, ""), nil, g, &updated)
+	return updated, err
+}
+
+//EditGuest changes the fields of the profile set in edit
+func (c *Client) EditGuest(ctx context.Context, id primitive.ObjectID, edit GuestEdit) (Guest, error) {
+	var g Guest
+	_, err := c.do(ctx, http.MethodPatch, guestPath(id, ""), nil, edit, &g)
+	return g, err
+}
+
+//DeleteGuest deletes a guest; RestoreGuest brings it back
+func (c *Client) DeleteGuest(ctx context.Context, id primitive.ObjectID) error {
+	_, err := c.do(ctx, http.MethodDelete, guestPath(id, ""), nil, nil, nil)
+	return err
+}
+
+//ListDeletedGuests returns the deleted guests
+func (c *Client) ListDeletedGuests(ctx context.Context) ([]Guest, error) {
+	var gs []Guest
+	_, err := c.do(ctx, http.MethodGet, "/guests/deleted", nil, nil, &gs)
+	return gs, err
+}
+
+//RestoreGuest restores a deleted guest
+func (c *Client) RestoreGuest(ctx context.Context, id primitive.ObjectID) error {
+	_, err := c.do(ctx, http.MethodPost, guestPath(id, "/restore"), nil, nil, nil)
+	return err
+}
+
+//PurgeGuest removes for good a deleted guest
+func (c *Client) PurgeGuest(ctx context.Context, id primitive.ObjectID) error {
+	_, err := c.do(ctx, http.MethodDelete, guestPath(id, "/purge"), nil, nil, nil)
+	return err
+}
+
+//ImportGuests creates the guests of a CSV whose header names the columns
+//user_name, invitees, country, language, password, plus_ones and email.
+//With dryRun nothing is stored
+func (c *Client) ImportGuests(ctx context.Context, csv io.Reader, dryRun bool) (ImportReport, error) {
+	var report ImportReport
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("file", "guests.csv")
+	if err == nil {
+		_, err = io.Copy(fw, csv)
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		return report, err
+	}
+
+	req := request{
+		method:      http.MethodPost,
+		path:        "/guests/import",
+		query:       url.Values{"dry_run": {strconv.FormatBool(dryRun)}},
+		body:        body.Bytes(),
+		contentType: mw.FormDataContentType(),
+	}
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+	return report, decode(resp, &report)
+}
+
+//ExportGuests downloads the guest list as a spreadsheet. The query sets the
+//format (csv or xlsx), the columns and the filters of ListGuests
+func (c *Client) ExportGuests(ctx context.Context, query url.Values) ([]byte, error) {
+	resp, err := c.send(ctx, request{method: http.MethodGet, path: "/guests/export", query: query})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+//GetGuestHistory returns the changes of a guest, and how many match the
+//query: actor, action, since, until, limit and offset
+func (c *Client) GetGuestHistory(ctx context.Context, id primitive.ObjectID, query url.Values) ([]HistoryEntry, int, error) {
+	var hs []HistoryEntry
+	resp, err := c.do(ctx, http.MethodGet, guestPath(id, "/history"), query, nil, &hs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hs, total(resp), nil
+}
+
+//AnswerEvent answers the invitation of a guest to an event
+func (c *Client) AnswerEvent(ctx context.Context, id, eventID primitive.ObjectID, answer EventAnswer) (Guest, error) {
+	var g Guest
+	_, err := c.do(ctx, http.MethodPut, guestPath(id, "/events/"+eventID.Hex()), nil, answer, &g)
+	return g, err
+}
+
+//RequestChange asks a change of the RSVP of a guest after the deadline
+func (c *Client) RequestChange(ctx context.Context, id primitive.ObjectID, rsvp RSVPAnswer, reason string) (ChangeRequest, error) {
+	var cr ChangeRequest
+	_, err := c.do(ctx, http.MethodPost, guestPath(id, "/changes"), nil, ChangeRequest{RSVP: rsvp, Reason: reason}, &cr)
+	return cr, err
+}
@@ -0,0 +1,322 @@
+package client
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The types are the JSON shapes of the API, copied from the server: TestClient
+// fails when they drift from the ones the handlers encode
+
+//Role is the role of a user, which grants the permissions of its token
+type Role string
+
+// The roles a user can have
+const (
+	RoleGuest   Role = "guest"
+	RoleViewer  Role = "viewer"
+	RolePlanner Role = "planner"
+	RoleAdmin   Role = "admin"
+)
+
+//UserAuth are the credentials of a login
+type UserAuth struct {
+	UserName string `json:"user_name"`
+	Password string `json:"password"`
+}
+
+//UserIdentification is the answer of a login: the tokens and who they are for
+type UserIdentification struct {
+	ID           string `json:"id"`
+	UserName     string `json:"user_name"`
+	Role         Role   `json:"role"`
+	JwtToken     string `json:"jwt_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+//RefreshRequest carries the refresh token of a refresh or a logout
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+//LinkAuth carries the token of an invitation link
+type LinkAuth struct {
+	Token string `json:"token"`
+}
+
+//LinkRequest sets the invitation link to generate
+type LinkRequest struct {
+	// TTL is the lifetime of the link, as "72h"; 14 days when empty
+	TTL string `json:"ttl"`
+	// SingleUse links log in once; true when not set
+	SingleUse *bool `json:"single_use"`
+}
+
+//GuestLink is an invitation link
+type GuestLink struct {
+	Token string `json:"token"`
+	// URL is the page of the site in the language of the guest, with the token
+	URL       string    `json:"url,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SingleUse bool      `json:"single_use"`
+}
+
+//Member is a person of the household of a guest
+type Member struct {
+	Name             string `json:"name"`
+	Child            bool   `json:"child"`
+	Attending        bool   `json:"attending"`
+	FoodRequirements string `json:"food_requirements"`
+	// Companion is set on the plus-ones named by the guest
+	Companion bool `json:"companion"`
+}
+
+//Event is an event of the wedding
+type Event struct {
+	ID       primitive.ObjectID `json:"id"`
+	Name     string             `json:"name"`
+	StartsAt time.Time          `json:"starts_at"`
+	Location string             `json:"location"`
+	// Capacity is the number of seats, 0 when unlimited
+	Capacity int `json:"capacity"`
+	// RSVPDeadline closes the answers to the event, the global deadline applies when nil
+	RSVPDeadline *time.Time `json:"rsvp_deadline,omitempty"`
+}
+
+//Invitation is the invitation of a guest to an event, and its answer
+type Invitation struct {
+	EventID primitive.ObjectID `json:"event_id"`
+	// Attendees are the names of the members coming to the event
+	Attendees   []string   `json:"attendees"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+	// Event is filled in the responses
+	Event *Event `json:"event,omitempty"`
+}
+
+//EventAnswer is the answer of a guest to an invitation: the attendees by name,
+//or everyone or no one with Attending
+type EventAnswer struct {
+	Attendees *[]string `json:"attendees"`
+	Attending *bool     `json:"attending"`
+}
+
+//Guest is an invitation and its RSVP. The password is empty in the responses
+type Guest struct {
+	ID                primitive.ObjectID `json:"id"`
+	Password          string             `json:"password"`
+	Invitees          string             `json:"invitees"`
+	UserName          string             `json:"user_name"`
+	Country           string             `json:"country"`
+	Language          string             `json:"language"`
+	Modification      string             `json:"modification"`
+	Confirmed         bool               `json:"confirmed"`
+	NeedsAccomodation bool               `json:"needs_accomodation"`
+	NeedsPassage      bool               `json:"needs_passage"`
+	FoodRequirements  string             `json:"food_requirements"`
+	Role              Role               `json:"role"`
+	DeletedAt         *time.Time         `json:"deleted_at,omitempty"`
+	// RespondedAt is the last RSVP of the guest, nil while pending
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+	// Members are the people of the household: Confirmed when one of them comes
+	Members []Member `json:"members"`
+	// PlusOnes is how many companions the guest can add to the members
+	PlusOnes int `json:"plus_ones"`
+	// Events are the invitations to the events of the wedding
+	Events []Invitation `json:"events"`
+	Email  string       `json:"email"`
+	// LastLoginAt is the last login of the guest, nil if never
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+//GuestEdit changes the profile of a guest: the nil fields are kept
+type GuestEdit struct {
+	UserName          *string   `json:"user_name,omitempty"`
+	Password          *string   `json:"password,omitempty"`
+	Invitees          *string   `json:"invitees,omitempty"`
+	Country           *string   `json:"country,omitempty"`
+	Language          *string   `json:"language,omitempty"`
+	Modification      *string   `json:"modification,omitempty"`
+	Confirmed         *bool     `json:"confirmed,omitempty"`
+	NeedsAccomodation *bool     `json:"needs_accomodation,omitempty"`
+	NeedsPassage      *bool     `json:"needs_passage,omitempty"`
+	FoodRequirements  *string   `json:"food_requirements,omitempty"`
+	Role              *Role     `json:"role,omitempty"`
+	Members           *[]Member `json:"members,omitempty"`
+	PlusOnes          *int      `json:"plus_ones,omitempty"`
+	// EventIDs are the events the guest is invited to
+	EventIDs *[]primitive.ObjectID `json:"event_ids,omitempty"`
+	Email    *string               `json:"email,omitempty"`
+}
+
+//RSVPAnswer is the RSVP asked by a change request
+type RSVPAnswer struct {
+	Confirmed         bool     `json:"confirmed"`
+	NeedsAccomodation bool     `json:"needs_accomodation"`
+	NeedsPassage      bool     `json:"needs_passage"`
+	FoodRequirements  string   `json:"food_requirements"`
+	Modification      string   `json:"modification"`
+	Members           []Member `json:"members"`
+}
+
+// Status of a change request
+const (
+	ChangePending  = "pending"
+	ChangeApproved = "approved"
+	ChangeRejected = "rejected"
+)
+
+//ChangeRequest asks a change of the RSVP after the deadline
+type ChangeRequest struct {
+	ID        primitive.ObjectID `json:"id"`
+	GuestID   primitive.ObjectID `json:"guest_id"`
+	UserName  string             `json:"user_name"`
+	RSVP      RSVPAnswer         `json:"rsvp"`
+	Reason    string             `json:"reason"`
+	Status    string             `json:"status"`
+	CreatedAt time.Time          `json:"created_at"`
+	DecidedAt *time.Time         `json:"decided_at,omitempty"`
+	// DecidedBy is the user name of the admin who approved or rejected the request
+	DecidedBy string `json:"decided_by,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+}
+
+//ChangeDecision is the comment of an approval or of a rejection
+type ChangeDecision struct {
+	Comment string `json:"comment"`
+}
+
+//FieldChange is the change of a field of a guest
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+//HistoryEntry is a change of a guest
+type HistoryEntry struct {
+	ID      primitive.ObjectID `json:"id"`
+	GuestID primitive.ObjectID `json:"guest_id"`
+	// UserName is the one of the guest when the change was made
+	UserName string `json:"user_name"`
+	// Actor is the user name of who made the change
+	Actor   string        `json:"actor"`
+	Action  string        `json:"action"`
+	At      time.Time     `json:"at"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// Status of an imported row
+const (
+	ImportCreated = "created"
+	ImportSkipped = "skipped"
+	ImportFailed  = "failed"
+)
+
+//ImportRow is the outcome of a CSV row
+type ImportRow struct {
+	Line     int    `json:"line"`
+	UserName string `json:"user_name"`
+	Status   string `json:"status"`
+	// Password is set only when generated: it has to be sent to the guest
+	Password string `json:"password,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Errors are the fields refused of a failed row
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+//ImportReport is the outcome of an import. With DryRun nothing was stored
+type ImportReport struct {
+	DryRun  bool        `json:"dry_run"`
+	Created int         `json:"created"`
+	Skipped int         `json:"skipped"`
+	Failed  int         `json:"failed"`
+	Rows    []ImportRow `json:"rows"`
+}
+
+//LoginBlock are the failed logins of a user name or of an address
+type LoginBlock struct {
+	// Kind is "user" or "ip"
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// RetryAt is when the next attempt is accepted
+	RetryAt time.Time `json:"retry_at"`
+	// LockedUntil is set while the key is locked out
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+//Message is an email of a guest
+type Message struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+}
+
+//Reminder is a campaign of reminders to answer the RSVP
+type Reminder struct {
+	ID        primitive.ObjectID `json:"id"`
+	SendAt    time.Time          `json:"send_at"`
+	CreatedAt time.Time          `json:"created_at"`
+	CreatedBy string             `json:"created_by"`
+	// DoneAt is set once every guest was gone through
+	DoneAt *time.Time `json:"done_at,omitempty"`
+	// Sent is how many guests had the reminder
+	Sent int `json:"sent"`
+}
+
+//ReminderSend is a reminder sent to a guest by a campaign
+type ReminderSend struct {
+	ReminderID primitive.ObjectID `json:"reminder_id"`
+	GuestID    primitive.ObjectID `json:"guest_id"`
+	UserName   string             `json:"user_name"`
+	Email      string             `json:"email"`
+	Language   string             `json:"language"`
+	// Reason is why the guest is reminded: no_answer or never_logged_in
+	Reason  string    `json:"reason"`
+	Subject string    `json:"subject"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+//ReminderPreview tells who a campaign would remind now
+type ReminderPreview struct {
+	Reminder   Reminder       `json:"reminder"`
+	Recipients []ReminderSend `json:"recipients"`
+	// WithoutEmail are the user names of the guests to remind without an email
+	WithoutEmail []string `json:"without_email"`
+}
+
+//RSVPCount counts the answers
+type RSVPCount struct {
+	Invited   int `json:"invited"`
+	Confirmed int `json:"confirmed"`
+	Declined  int `json:"declined"`
+	Pending   int `json:"pending"`
+}
+
+//GuestStats are the RSVP numbers
+type GuestStats struct {
+	RSVPCount
+	Headcount         int                  `json:"headcount"`
+	Children          int                  `json:"children"`
+	PlusOnesAllowed   int                  `json:"plus_ones_allowed"`
+	PlusOnesUsed      int                  `json:"plus_ones_used"`
+	NeedsAccomodation int                  `json:"needs_accomodation"`
+	NeedsPassage      int                  `json:"needs_passage"`
+	FoodRequirements  map[string]int       `json:"food_requirements"`
+	ByCountry         map[string]RSVPCount `json:"by_country"`
+	ByLanguage        map[string]RSVPCount `json:"by_language"`
+	Events            []EventStats         `json:"events"`
+}
+
+//EventStats are the answers to an event
+type EventStats struct {
+	ID        primitive.ObjectID `json:"id"`
+	Name      string             `json:"name"`
+	Capacity  int                `json:"capacity"`
+	Invited   int                `json:"invited"`
+	Responded int                `json:"responded"`
+	Attendees int                `json:"attendees"`
+}
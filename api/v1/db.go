@@ -1,7 +1,14 @@
 package main
 
 import (
-	mgo "gopkg.in/mgo.v2"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
@@ -9,36 +16,185 @@ const (
 	guestCollection = "GUESTS"
 	//TOKEN_COLLECTION is the name of the MongoDb token coll
 	tokenCollection = "TOKEN"
+	//EVENT_COLLECTION is the name of the MongoDb event coll
+	eventCollection = "EVENTS"
+	//CHANGE_COLLECTION is the name of the MongoDb change request coll
+	changeCollection = "CHANGES"
+	//HISTORY_COLLECTION is the name of the MongoDb history coll
+	historyCollection = "HISTORY"
+	//REMINDER_COLLECTION is the name of the MongoDb reminder campaign coll
+	reminderCollection = "REMINDERS"
+	//REMINDER_SEND_COLLECTION is the name of the MongoDb coll of the reminders sent
+	reminderSendCollection = "REMINDER_SENDS"
 	//DB_NAME is the name of the MongoDb DB
 	dbName = "L_C_WED"
 )
 
-//DataBridge is the struct handling the Guest Collection
+//ErrNotFound is returned by every store when the requested item does not exist
+var ErrNotFound = errors.New("not found")
+
+//GuestStore is the persistence contract for the guests
+//Deleted guests are only visible through ReadGuestByID and ReadDeleted
+type GuestStore interface {
+	CreateGuest(ctx context.Context, g *Guest) error
+	ReadGuest(ctx context.Context, userName string) (Guest, error)
+	ReadGuestByID(ctx context.Context, id primitive.ObjectID) (Guest, error)
+	ReadAll(ctx context.Context) ([]Guest, error)
+	// QueryGuests returns a page of the guests and how many match the filters
+	QueryGuests(ctx context.Context, q GuestQuery) ([]Guest, int, error)
+	ReadDeleted(ctx context.Context) ([]Guest, error)
+	UpdateGuest(ctx context.Context, g *Guest) error
+	EditGuest(ctx context.Context, g *Guest) error
+	DeleteGuest(ctx context.Context, id primitive.ObjectID) error
+	RestoreGuest(ctx context.Context, id primitive.ObjectID) error
+	PurgeGuest(ctx context.Context, id primitive.ObjectID) error
+	// RecordLogin set the time of the last login of a guest
+	RecordLogin(ctx context.Context, id primitive.ObjectID, at time.Time) error
+	AuthGuest(ctx context.Context, username, password string) (*UserIdentification, error)
+}
+
+//AuthStore is the persistence contract for the authorizations
+type AuthStore interface {
+	InsertAuth(ctx context.Context, a Auth) error
+	ReadAuth(ctx context.Context, token string) (Auth, error)
+	UpdateAuth(ctx context.Context, auth *Auth) error
+	RevokeUserAuths(ctx context.Context, user string) error
+	RevokeUserAuthKind(ctx context.Context, user, kind string) error
+}
+
+//EventStore is the persistence contract for the events
+type EventStore interface {
+	CreateEvent(ctx context.Context, e *Event) error
+	ReadEvent(ctx context.Context, id primitive.ObjectID) (Event, error)
+	ReadEvents(ctx context.Context) ([]Event, error)
+	UpdateEvent(ctx context.Context, e *Event) error
+	// DeleteEvent removes the invitations to the event as well
+	DeleteEvent(ctx context.Context, id primitive.ObjectID) error
+}
+
+//ChangeStore is the persistence contract for the change requests
+type ChangeStore interface {
+	CreateChange(ctx context.Context, c *ChangeRequest) error
+	ReadChange(ctx context.Context, id primitive.ObjectID) (ChangeRequest, error)
+	// ReadChanges lists the requests by creation time, every status when status is empty
+	ReadChanges(ctx context.Context, status string) ([]ChangeRequest, error)
+	// DecideChange returns ErrChangeDecided when the request is no longer pending
+	DecideChange(ctx context.Context, c *ChangeRequest) error
+	// ReopenChange puts back to pending a request decided with status,
+	// when the decision couldn't be carried out
+	ReopenChange(ctx context.Context, id primitive.ObjectID, status string) error
+}
+
+//HistoryStore is the persistence contract for the history of the guests:
+//the entries are only appended
+type HistoryStore interface {
+	AppendHistory(ctx context.Context, h *HistoryEntry) error
+	// ReadHistory returns a page of the history and how many entries match the filters
+	ReadHistory(ctx context.Context, q HistoryQuery) ([]HistoryEntry, int, error)
+}
+
+//ReminderStore is the persistence contract for the reminder campaigns
+//and the reminders sent
+type ReminderStore interface {
+	CreateReminder(ctx context.Context, rm *Reminder) error
+	ReadReminder(ctx context.Context, id primitive.ObjectID) (Reminder, error)
+	// ReadReminders lists the campaigns by sending date
+	ReadReminders(ctx context.Context) ([]Reminder, error)
+	// DeleteReminder returns ErrReminderDone when the campaign was sent
+	DeleteReminder(ctx context.Context, id primitive.ObjectID) error
+	CompleteReminder(ctx context.Context, id primitive.ObjectID, at time.Time) error
+	// RecordReminderSend returns ErrReminderSent when the guest already had the reminder
+	RecordReminderSend(ctx context.Context, s *ReminderSend) error
+	ReadReminderSends(ctx context.Context, reminderID primitive.ObjectID) ([]ReminderSend, error)
+}
+
+//Store gathers everything the API needs to persist
+type Store interface {
+	GuestStore
+	AuthStore
+	EventStore
+	ChangeStore
+	HistoryStore
+	ReminderStore
+	// Close releases the resources of the store, once the handlers are done
+	Close() error
+}
+
+//DataBridge is the struct handling the MongoDb collections.
+//The client owns a connection pool shared by every request
 type DataBridge struct {
-	masterSession *mgo.Session
+	client *mongo.Client
 }
 
-func (db *DataBridge) guestColl() (*mgo.Collection, error) {
-	//Ping to check the availability
-	if err := db.masterSession.Ping(); err != nil {
-		return nil, err
-	}
-	copySession := db.masterSession.Clone()
-	return copySession.DB(dbName).C(guestCollection), nil
+func (db *DataBridge) guestColl() *mongo.Collection {
+	return db.client.Database(dbName).Collection(guestCollection)
+}
+
+func (db *DataBridge) tokenColl() *mongo.Collection {
+	return db.client.Database(dbName).Collection(tokenCollection)
+}
+
+//Init set the connected client and creates the indexes the stores rely on
+func (db *DataBridge) Init(client *mongo.Client) error {
+
+	db.client = client
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return db.createIndexes(ctx)
+}
+
+//Close does nothing: the client is shared, main disconnects it
+func (db *DataBridge) Close() error {
+	return nil
 }
 
-func (db *DataBridge) tokenColl() (*mgo.Collection, error) {
-	//Ping to check the availability
-	if err := db.masterSession.Ping(); err != nil {
-		return nil, err
+// createIndexes creates the unique indexes, if missing. A partial index can't
+// select the guests without deleted_at: with it in the key, the username is
+// unique among the guests not deleted, the deleted ones differing by date
+func (db *DataBridge) createIndexes(ctx context.Context) error {
+	unique := options.Index().SetUnique(true)
+	indexes := []struct {
+		coll  *mongo.Collection
+		model mongo.IndexModel
+	}{
+		{db.guestColl(), mongo.IndexModel{
+			Keys: bson.D{{Key: "user_name", Value: 1}, {Key: "deleted_at", Value: 1}}, Options: unique}},
+		{db.tokenColl(), mongo.IndexModel{Keys: bson.D{{Key: "token", Value: 1}}, Options: unique}},
+		{db.reminderSendColl(), mongo.IndexModel{
+			Keys: bson.D{{Key: "reminder_id", Value: 1}, {Key: "guest_id", Value: 1}}, Options: unique}},
+	}
+	for _, i := range indexes {
+		if _, err := i.coll.Indexes().CreateOne(ctx, i.model); err != nil {
+			return err
+		}
 	}
-	copySession := db.masterSession.Clone()
-	return copySession.DB(dbName).C(tokenCollection), nil
+	return nil
 }
 
-//Init set the master session
-func (db *DataBridge) Init(session *mgo.Session) {
+// mongoErr translates the driver specific errors in the store ones
+func mongoErr(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
 
-	db.masterSession = session
+// mongoGuestErr translates the violation of the unique username of the guests
+func mongoGuestErr(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrUserNameTaken
+	}
+	return err
+}
 
+// updateErr returns ErrNotFound when an update did not match any document
+func updateErr(res *mongo.UpdateResult, err error) error {
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//ErrEventFull is returned when the answers exceed the capacity of an event
+var ErrEventFull = errors.New("Event is full")
+
+//Event is a moment of the wedding the guests are invited to:
+//ceremony, reception, brunch...
+type Event struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	Name     string             `json:"name" bson:"name"`
+	StartsAt time.Time          `json:"starts_at" bson:"starts_at"`
+	Location string             `json:"location" bson:"location"`
+	// Capacity is the number of seats, 0 when unlimited
+	Capacity int `json:"capacity" bson:"capacity"`
+	// RSVPDeadline closes the answers to the event, the global deadline applies when nil
+	RSVPDeadline *time.Time `json:"rsvp_deadline,omitempty" bson:"rsvp_deadline,omitempty"`
+}
+
+//Invitation is the answer of a guest to an event
+type Invitation struct {
+	EventID primitive.ObjectID `json:"event_id" bson:"event_id"`
+	// Attendees are the names of the members coming to the event
+	Attendees   []string   `json:"attendees" bson:"attendees"`
+	RespondedAt *time.Time `json:"responded_at,omitempty" bson:"responded_at,omitempty"`
+	// Event is only filled in the responses, never stored
+	Event *Event `json:"event,omitempty" bson:"-"`
+}
+
+// validateEvent checks the fields set by the admin
+func validateEvent(e *Event) error {
+	e.Name = strings.TrimSpace(e.Name)
+	if e.Name == "" {
+		return fieldError("name", errors.New("Event name is required"))
+	}
+	if e.Capacity < 0 {
+		return fieldError("capacity", errors.New("Capacity can't be negative"))
+	}
+	return nil
+}
+
+// invitation returns the index of the invitation to the event, -1 if not invited
+func (g Guest) invitation(eventID primitive.ObjectID) int {
+	for i, inv := range g.Events {
+		if inv.EventID == eventID {
+			return i
+		}
+	}
+	return -1
+}
+
+// inviteTo keeps the answers of the events still invited to and adds the new ones
+func (g *Guest) inviteTo(ids []primitive.ObjectID) {
+	invs := []Invitation{}
+	seen := make(map[primitive.ObjectID]bool)
+	for _, id := range ids {
+		// the same event listed twice is invited once
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if i := g.invitation(id); i >= 0 {
+			invs = append(invs, g.Events[i])
+		} else {
+			invs = append(invs, Invitation{EventID: id, Attendees: []string{}})
+		}
+	}
+	g.Events = invs
+}
+
+// answerEvent sets the attendees of an event; the members come to the
+// wedding when they attend at least one event
+func (g *Guest) answerEvent(i int, attendees []string) {
+	now := time.Now()
+	g.Events[i].Attendees = attendees
+	g.Events[i].RespondedAt = &now
+
+	if len(g.Members) == 0 {
+		g.Confirmed = false
+		for _, inv := range g.Events {
+			g.Confirmed = g.Confirmed || len(inv.Attendees) > 0
+		}
+		return
+	}
+	for m := range g.Members {
+		g.Members[m].Attending = false
+		for _, inv := range g.Events {
+			if findName(inv.Attendees, g.Members[m].Name) {
+				g.Members[m].Attending = true
+			}
+		}
+	}
+	g.syncMembers()
+}
+
+// answerEvents gives the answer of the RSVP to every event invited to
+func (g *Guest) answerEvents() {
+	attendees := []string{}
+	for _, m := range g.Members {
+		if m.Attending {
+			attendees = append(attendees, m.Name)
+		}
+	}
+	now := time.Now()
+	for i := range g.Events {
+		g.Events[i].Attendees = append([]string{}, attendees...)
+		g.Events[i].RespondedAt = &now
+	}
+}
+
+func findName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventSeats counts the attendees of an event, except the ones of the guest skipped
+func eventSeats(gs []Guest, eventID, skipped primitive.ObjectID) int {
+	n := 0
+	for _, g := range gs {
+		if g.ID == skipped {
+			continue
+		}
+		if i := g.invitation(eventID); i >= 0 {
+			n += len(g.Events[i].Attendees)
+		}
+	}
+	return n
+}
+
+func (db *DataBridge) eventColl() *mongo.Collection {
+	return db.client.Database(dbName).Collection(eventCollection)
+}
+
+//CreateEvent store a new event
+func (db *DataBridge) CreateEvent(ctx context.Context, e *Event) error {
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	e.ID = primitive.NewObjectID()
+	_, err := db.eventColl().InsertOne(ctx, e)
+	return err
+}
+
+//ReadEvent fetch an event by id
+func (db *DataBridge) ReadEvent(ctx context.Context, id primitive.ObjectID) (Event, error) {
+	var e Event
+
+	err := db.eventColl().FindOne(ctx, bson.M{"_id": id}).Decode(&e)
+	return e, mongoErr(err)
+}
+
+//ReadEvents fetch every event, by starting time
+func (db *DataBridge) ReadEvents(ctx context.Context) ([]Event, error) {
+	es := []Event{}
+
+	cur, err := db.eventColl().Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "starts_at", Value: 1}}))
+	if err != nil {
+		return es, err
+	}
+	err = cur.All(ctx, &es)
+	return es, err
+}
+
+//UpdateEvent replaces the fields of an event
+func (db *DataBridge) UpdateEvent(ctx context.Context, e *Event) error {
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	return updateErr(db.eventColl().UpdateOne(ctx, bson.M{"_id": e.ID}, bson.M{"$set": bson.M{
+		"name":          e.Name,
+		"starts_at":     e.StartsAt,
+		"location":      e.Location,
+		"capacity":      e.Capacity,
+		"rsvp_deadline": e.RSVPDeadline,
+	}}))
+}
+
+//DeleteEvent removes an event and the invitations to it
+func (db *DataBridge) DeleteEvent(ctx context.Context, id primitive.ObjectID) error {
+	res, err := db.eventColl().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	_, err = db.guestColl().UpdateMany(ctx, bson.M{"events.event_id": id},
+		bson.M{"$pull": bson.M{"events": bson.M{"event_id": id}}})
+	return err
+}
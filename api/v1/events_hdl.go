@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//EventAnswer is the RSVP of a guest to an event: the members attending,
+//or Attending for the whole household
+type EventAnswer struct {
+	Attendees *[]string `json:"attendees"`
+	Attending *bool     `json:"attending"`
+}
+
+// idFromVars parses the id named name of the request URI
+func idFromVars(r *http.Request, name string) (primitive.ObjectID, error) {
+	id, ok := mux.Vars(r)[name]
+	if !ok {
+		return primitive.NilObjectID, errors.New("No Id " + name)
+	}
+	return primitive.ObjectIDFromHex(id)
+}
+
+// attachEvents fills the event of the invitations, for the responses
+func (hb *HandlerBridge) attachEvents(r *http.Request, gs []Guest) error {
+	return attachEvents(r.Context(), hb.db, gs)
+}
+
+// attachEvents fills the event of the invitations from the store
+func attachEvents(ctx context.Context, es EventStore, gs []Guest) error {
+	events, err := es.ReadEvents(ctx)
+	if err != nil {
+		return err
+	}
+	byID := make(map[primitive.ObjectID]Event, len(events))
+	for _, e := range events {
+		byID[e.ID] = e
+	}
+	for i := range gs {
+		for j, inv := range gs[i].Events {
+			if e, ok := byID[inv.EventID]; ok {
+				gs[i].Events[j].Event = &e
+			}
+		}
+	}
+	return nil
+}
+
+// eventLocks serializes the answers to each event, from the check of its
+// capacity to the update of the guest. Only the answers handled by this
+// process are serialized
+type eventLocks struct {
+	mu    sync.Mutex
+	locks map[primitive.ObjectID]*sync.Mutex
+}
+
+// lock takes the locks of the events g attends, always in the same order,
+// and returns the function releasing them
+func (el *eventLocks) lock(g Guest) func() {
+	var ids []primitive.ObjectID
+	for _, inv := range g.Events {
+		if len(inv.Attendees) > 0 {
+			ids = append(ids, inv.EventID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Hex() < ids[j].Hex() })
+
+	el.mu.Lock()
+	if el.locks == nil {
+		el.locks = make(map[primitive.ObjectID]*sync.Mutex)
+	}
+	ms := make([]*sync.Mutex, len(ids))
+	for i, id := range ids {
+		if el.locks[id] == nil {
+			el.locks[id] = new(sync.Mutex)
+		}
+		ms[i] = el.locks[id]
+	}
+	el.mu.Unlock()
+
+	for _, m := range ms {
+		m.Lock()
+	}
+	return func() {
+		for i := len(ms) - 1; i >= 0; i-- {
+			ms[i].Unlock()
+		}
+	}
+}
+
+// saveAnswers updates the guest once its answers checked against the
+// capacity of the events: no other answer to them is saved in between
+func (hb *HandlerBridge) saveAnswers(r *http.Request, g *Guest) error {
+	defer hb.events.lock(*g)()
+	if err := hb.checkCapacity(r, *g); err != nil {
+		return err
+	}
+	return hb.db.UpdateGuest(r.Context(), g)
+}
+
+// checkCapacity refuses the answers of g filling an event over its capacity
+func (hb *HandlerBridge) checkCapacity(r *http.Request, g Guest) error {
+	var gs []Guest
+	for _, inv := range g.Events {
+		if len(inv.Attendees) == 0 {
+			continue
+		}
+		e, err := hb.db.ReadEvent(r.Context(), inv.EventID)
+		if err != nil {
+			return err
+		}
+		if e.Capacity == 0 {
+			continue
+		}
+		if gs == nil {
+			if gs, err = hb.db.ReadAll(r.Context()); err != nil {
+				return err
+			}
+		}
+		if eventSeats(gs, e.ID, g.ID)+len(inv.Attendees) > e.Capacity {
+			return ErrEventFull
+		}
+	}
+	return nil
+}
+
+//GetEvents retrieve the events, by starting time
+func (hb *HandlerBridge) GetEvents(w http.ResponseWriter, r *http.Request) {
+	es, err := hb.db.ReadEvents(r.Context())
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, es)
+}
+
+//AddEvent return the provided created event with the created id
+func (hb *HandlerBridge) AddEvent(w http.ResponseWriter, r *http.Request) {
+	var e Event
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	if err := validateEvent(&e); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	if err := hb.db.CreateEvent(r.Context(), &e); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, e)
+}
+
+//ModifyEvent replaces the name, time, location and capacity of an event
+func (hb *HandlerBridge) ModifyEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	var e Event
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(&e); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	e.ID = id
+	if err = validateEvent(&e); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	if err = hb.db.UpdateEvent(r.Context(), &e); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, e)
+}
+
+//RemoveEvent deletes an event and the invitations to it
+func (hb *HandlerBridge) RemoveEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	if err = hb.db.DeleteEvent(r.Context(), id); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, "Event deleted")
+}
+
+//AnswerEvent is the RSVP of a guest to one of the events it is invited to
+func (hb *HandlerBridge) AnswerEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := guestIDFromVars(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	eventID, err := idFromVars(r, "event_id")
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	var answer EventAnswer
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(&answer); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	g, err := hb.db.ReadGuestByID(r.Context(), id)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	i := g.invitation(eventID)
+	if i < 0 {
+		hb.fail(w, r, newAPIError(http.StatusNotFound, CodeNotFound, "Guest not invited to the event"))
+		return
+	}
+	if err = checkRSVPOpen(r.Context(), hb.db, g, &eventID); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	attendees, err := validateEventAnswer(g, answer)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	before := g.clone()
+	g.answerEvent(i, attendees)
+	// the RSVP is answered, even if declined
+	g.RespondedAt = g.Events[i].RespondedAt
+	if err = hb.saveAnswers(r, &g); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyEventAnswer, before, g)
+	hb.notifier.Notify(rsvpNotice(before, g))
+	hb.sendConfirmation(r, g)
+
+	gs := []Guest{g}
+	if err = hb.attachEvents(r, gs); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	gs[0].Password = ""
+	hb.rnd.JSON(w, http.StatusOK, gs[0])
+}
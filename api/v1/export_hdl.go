@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// exportColumn is a column of the export: passwords are never one of them
+type exportColumn struct {
+	name  string
+	value func(g Guest) string
+}
+
+// exportColumns in their default order
+var exportColumns = []exportColumn{
+	{"user_name", func(g Guest) string { return g.UserName }},
+	{"invitees", func(g Guest) string { return g.Invitees }},
+	{"members", exportMembers},
+	{"headcount", func(g Guest) string { return strconv.Itoa(partySize(g)) }},
+	{"plus_ones", func(g Guest) string { return strconv.Itoa(g.PlusOnes) }},
+	{"plus_ones_used", func(g Guest) string { return strconv.Itoa(g.companions()) }},
+	{"events", exportEvents},
+	{"country", func(g Guest) string { return g.Country }},
+	{"language", func(g Guest) string { return g.Language }},
+	{"email", func(g Guest) string { return g.Email }},
+	{"confirmed", func(g Guest) string { return strconv.FormatBool(g.Confirmed) }},
+	{"needs_accomodation", func(g Guest) string { return strconv.FormatBool(g.NeedsAccomodation) }},
+	{"needs_passage", func(g Guest) string { return strconv.FormatBool(g.NeedsPassage) }},
+	{"food_requirements", func(g Guest) string { return g.FoodRequirements }},
+	{"modification", func(g Guest) string { return g.Modification }},
+	{"role", func(g Guest) string { return string(roleOf(g)) }},
+}
+
+// exportMembers lists the household: "Anna (child, vegan); Marco (not attending); Lea (companion)"
+func exportMembers(g Guest) string {
+	var ms []string
+	for _, m := range g.Members {
+		var notes []string
+		if m.Companion {
+			notes = append(notes, "companion")
+		}
+		if m.Child {
+			notes = append(notes, "child")
+		}
+		if !m.Attending {
+			notes = append(notes, "not attending")
+		}
+		if m.FoodRequirements != "" {
+			notes = append(notes, m.FoodRequirements)
+		}
+		if len(notes) > 0 {
+			ms = append(ms, m.Name+" ("+strings.Join(notes, ", ")+")")
+		} else {
+			ms = append(ms, m.Name)
+		}
+	}
+	return strings.Join(ms, "; ")
+}
+
+// exportEvents lists the attendees of each invitation: "Ceremony: 2; Brunch: pending".
+// The events must be attached
+func exportEvents(g Guest) string {
+	var invs []string
+	for _, inv := range g.Events {
+		name := inv.EventID.Hex()
+		if inv.Event != nil {
+			name = inv.Event.Name
+		}
+		if inv.RespondedAt == nil {
+			invs = append(invs, name+": pending")
+		} else {
+			invs = append(invs, name+": "+strconv.Itoa(len(inv.Attendees)))
+		}
+	}
+	return strings.Join(invs, "; ")
+}
+
+// exportSelectColumns picks the columns of a comma separated list, all of them when empty
+func exportSelectColumns(list string) ([]exportColumn, error) {
+	if list == "" {
+		return exportColumns, nil
+	}
+	var cols []exportColumn
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		found := false
+		for _, col := range exportColumns {
+			if col.name == name {
+				cols = append(cols, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown column %q", name)
+		}
+	}
+	return cols, nil
+}
+
+// exportCell keeps spreadsheets from running the guests input as formulas
+func exportCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// exportRows returns the header and the cells of the guests
+func exportRows(gs []Guest, cols []exportColumn) [][]string {
+	rows := make([][]string, 0, len(gs)+1)
+	header := make([]string, len(cols))
+	for i, col := range cols {
+		header[i] = col.name
+	}
+	rows = append(rows, header)
+	for _, g := range gs {
+		row := make([]string, len(cols))
+		for i, col := range cols {
+			row[i] = exportCell(col.value(g))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func writeCSV(w http.ResponseWriter, rows [][]string) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="guests.csv"`)
+	cw := csv.NewWriter(w)
+	cw.WriteAll(rows)
+	return cw.Error()
+}
+
+func writeXLSX(w http.ResponseWriter, rows [][]string) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	for i, row := range rows {
+		cells := make([]interface{}, len(row))
+		for j, c := range row {
+			cells[j] = c
+		}
+		cell, err := excelize.CoordinatesToCellName(1, i+1)
+		if err != nil {
+			return err
+		}
+		if err = f.SetSheetRow(sheet, cell, &cells); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", `attachment; filename="guests.xlsx"`)
+	_, err := f.WriteTo(w)
+	return err
+}
+
+//ExportGuests downloads the guest list as a spreadsheet.
+//Query: format=csv|xlsx (csv by default), columns=user_name,invitees,...
+//and the filters of the guest list
+func (hb *HandlerBridge) ExportGuests(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	write := writeCSV
+	switch q.Get("format") {
+	case "", "csv":
+	case "xlsx":
+		write = writeXLSX
+	default:
+		hb.fail(w, r, fieldError("format", errors.New("Unknown format")))
+		return
+	}
+	cols, err := exportSelectColumns(q.Get("columns"))
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	// same filters as the list, without pages
+	filters, err := parseGuestFilters(q)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	gs, _, err := hb.db.QueryGuests(r.Context(), filters)
+	if err == nil {
+		err = hb.attachEvents(r, gs)
+	}
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	if err = write(w, exportRows(gs, cols)); err != nil {
+		log.Printf("Export: %s", err)
+	}
+}
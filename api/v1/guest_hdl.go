@@ -2,14 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-
-	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
 	"github.com/thedevsaddam/renderer"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 //UserAuth is a utility Structure to contain basic auth information
@@ -20,22 +22,30 @@ type UserAuth struct {
 
 //HandlerBridge is the struct used to provide the http.Handler
 type HandlerBridge struct {
-	db  DataBridge
+	db  Store
 	rnd *renderer.Render
+	// outbox sends the emails, nil when no SMTP relay is configured
+	outbox *Outbox
+	// notifier tells the couple about the RSVP changes, nil when not configured
+	notifier *Notifier
+	// guard slows down the guessing of the passwords
+	guard *LoginGuard
+	// events serializes the answers to the events
+	events eventLocks
 }
 
 //Init : initialize the handlerBridge
-func (hb *HandlerBridge) Init(d DataBridge) {
+func (hb *HandlerBridge) Init(d Store) {
 	hb.db = d
 	hb.rnd = renderer.New()
 }
 
 //CreateHandler is the wrapper to execute the validation middleware
-func (hb *HandlerBridge) CreateHandler(handler http.HandlerFunc, APICode int) http.HandlerFunc {
+func (hb *HandlerBridge) CreateHandler(handler http.HandlerFunc, perm Permission) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// validate the Request
-		if err := newValidator(r, &hb.db, APICode)(r, &hb.db); err != nil {
-			hb.rnd.JSON(w, http.StatusForbidden, err.Error())
+		if err := newValidator(r, hb.db, perm)(r, hb.db); err != nil {
+			hb.fail(w, r, err)
 			return
 		}
 		handler.ServeHTTP(w, r)
@@ -49,16 +59,30 @@ func (hb *HandlerBridge) AddGuest(w http.ResponseWriter, r *http.Request) {
 	var g Guest
 	defer r.Body.Close()
 
-	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+	if err := decodeStrict(r.Body, &g); err != nil {
 		log.Print(err.Error())
-		hb.rnd.JSON(w, http.StatusBadRequest, err.Error())
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	if err := validateNewGuest(&g, true); err != nil {
+		hb.fail(w, r, err)
 		return
 	}
 
-	if err := hb.db.CreateGuest(&g); err != nil {
-		hb.rnd.JSON(w, http.StatusInternalServerError, err.Error())
+	// Only who manages the roles can create something else than a guest
+	if roleOf(g) != RoleGuest {
+		a, err := requestAuth(r, hb.db)
+		if err != nil || !roleHasPermission(a.Role, PermManageRoles) {
+			hb.fail(w, r, forbidden("User is not authorized to assign roles"))
+			return
+		}
+	}
+
+	if err := hb.db.CreateGuest(r.Context(), &g); err != nil {
+		hb.fail(w, r, err)
 		return
 	}
+	hb.record(r, historyCreate, Guest{}, g)
 
 	hb.rnd.JSON(w, http.StatusOK, g)
 
@@ -70,78 +94,336 @@ func (hb *HandlerBridge) ModifyGuest(w http.ResponseWriter, r *http.Request) {
 	id, ok := mux.Vars(r)["id"]
 
 	if !ok {
-		hb.rnd.JSON(w, http.StatusBadRequest, "No Guest Id")
+		hb.fail(w, r, badRequest(errors.New("No Guest Id")))
 		return
 	}
 
 	var g Guest
 	defer r.Body.Close()
 
-	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
-		hb.rnd.JSON(w, http.StatusBadRequest, err.Error())
+	if err := decodeStrict(r.Body, &g); err != nil {
+		hb.fail(w, r, badRequest(err))
 		return
 	}
 
 	if id != g.ID.Hex() {
-		hb.rnd.JSON(w, http.StatusForbidden, "Invalid Guest provided")
+		hb.fail(w, r, forbidden("Invalid Guest provided"))
 		return
 	}
 
-	if err := hb.db.UpdateGuest(&g); err != nil {
-		hb.rnd.JSON(w, http.StatusInternalServerError, err.Error())
+	stored, err := hb.db.ReadGuestByID(r.Context(), g.ID)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	if err = validateGuestUpdate(&g, stored); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	if err = validateRSVP(stored, g); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	before := stored.clone()
+	if err = hb.applyRSVP(r, &stored, g); err != nil {
+		hb.fail(w, r, err)
 		return
 	}
+	hb.record(r, historyRSVP, before, stored)
+	hb.notifier.Notify(rsvpNotice(before, stored))
+	hb.sendConfirmation(r, stored)
 
-	hb.rnd.JSON(w, http.StatusOK, g)
+	// Clear password
+	stored.Password = ""
+	hb.rnd.JSON(w, http.StatusOK, stored)
 
 }
 
+// applyRSVP answers the RSVP of the stored guest and saves it: for the guest
+// before the deadline, for the admin approving a change request after
+func (hb *HandlerBridge) applyRSVP(r *http.Request, stored *Guest, rsvp Guest) error {
+	stored.answerRSVP(rsvp)
+	stored.answerEvents()
+
+	// the RSVP is answered, even if declined
+	now := time.Now()
+	stored.RespondedAt = &now
+	return hb.saveAnswers(r, stored)
+}
+
 //GetGuestByUsername Look up for a guest: use the username as parameter
 func (hb *HandlerBridge) GetGuestByUsername(w http.ResponseWriter, r *http.Request) {
 	un, ok := mux.Vars(r)["user_name"]
 
 	if !ok {
-		hb.rnd.JSON(w, http.StatusBadRequest, "No Username provided")
+		hb.fail(w, r, fieldError("user_name", errors.New("No Username provided")))
 		return
 	}
 
 	if !sanitizeUserName(un) {
-		hb.rnd.JSON(w, http.StatusBadRequest, "Invalid Username")
+		hb.fail(w, r, ErrInvalidUserName)
 		return
 	}
 
 	var g Guest
 	var err error
-	g, err = hb.db.ReadGuest(bson.M{"user_name": un})
+	g, err = hb.db.ReadGuest(r.Context(), un)
 
 	if err != nil {
-		hb.rnd.JSON(w, http.StatusBadRequest, err.Error())
+		hb.fail(w, r, unknownUser(err))
+		return
+	}
+	gs := []Guest{g}
+	if err = hb.attachEvents(r, gs); err != nil {
+		hb.fail(w, r, err)
 		return
 	}
+	g = gs[0]
 	// Clear password
 	g.Password = ""
 	hb.rnd.JSON(w, http.StatusOK, g)
 }
 
-//GetGuestAll retrieve all guests
+//GetGuestAll retrieve a page of the guests. The query filters on confirmed,
+//needs_accomodation, needs_passage, country, language and search (a part of
+//the invitees), sorts with sort=field or sort=-field and pages with limit and offset.
+//The X-Total-Count header tells how many guests match the filters
 func (hb *HandlerBridge) GetGuestAll(w http.ResponseWriter, r *http.Request) {
+	q, err := parseGuestQuery(r.URL.Query())
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
 
-	gs, err := hb.db.ReadAll()
+	gs, total, err := hb.db.QueryGuests(r.Context(), q)
 
 	if err != nil {
-		hb.rnd.JSON(w, http.StatusInternalServerError, err.Error())
+		hb.fail(w, r, err)
 		return
 	}
+	// Clear passwords
+	for i := range gs {
+		gs[i].Password = ""
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	hb.rnd.JSON(w, http.StatusOK, gs)
 }
 
-func createToken(ui *UserIdentification) error {
+// guestIDFromVars parses the guest id of the request URI
+func guestIDFromVars(r *http.Request) (primitive.ObjectID, error) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		return primitive.NilObjectID, errors.New("No Guest Id")
+	}
+	return primitive.ObjectIDFromHex(id)
+}
+
+//EditGuestProfile lets an admin change any field of a guest. Changing the
+//username, the password or the role revokes the tokens of the guest
+func (hb *HandlerBridge) EditGuestProfile(w http.ResponseWriter, r *http.Request) {
+	id, err := guestIDFromVars(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	var e GuestEdit
+	defer r.Body.Close()
+
+	if err = decodeStrict(r.Body, &e); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	g, err := hb.db.ReadGuestByID(r.Context(), id)
+	if err == nil && g.DeletedAt != nil {
+		err = ErrNotFound
+	}
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	// apply changes the members in place
+	previous := g.clone()
+
+	if err = e.apply(&g); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	if err = validateGuestUpdate(&g, previous); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	// the admin is looked up by name and must keep its rights
+	if previous.UserName == adminUser && (g.UserName != adminUser || g.Role != RoleAdmin) {
+		hb.fail(w, r, forbidden("The admin username and role can't be changed"))
+		return
+	}
+	if roleOf(g) != roleOf(previous) {
+		a, err := requestAuth(r, hb.db)
+		if err != nil || !roleHasPermission(a.Role, PermManageRoles) {
+			hb.fail(w, r, forbidden("User is not authorized to assign roles"))
+			return
+		}
+	}
+	if e.EventIDs != nil {
+		for _, inv := range g.Events {
+			_, err = hb.db.ReadEvent(r.Context(), inv.EventID)
+			if err == ErrNotFound {
+				hb.fail(w, r, fieldError("event_ids", errors.New("Unknown event "+inv.EventID.Hex())))
+				return
+			}
+			if err != nil {
+				hb.fail(w, r, err)
+				return
+			}
+		}
+	}
+	if g.UserName != previous.UserName {
+		if err = checkUserNameFree(r.Context(), hb.db, g.UserName, g.ID); err != nil {
+			hb.fail(w, r, err)
+			return
+		}
+	}
+
+	if err = hb.db.EditGuest(r.Context(), &g); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyEdit, previous, g)
+
+	// the tokens carry the username and the role, and were obtained with the old password
+	if g.UserName != previous.UserName || g.Password != previous.Password || roleOf(g) != roleOf(previous) {
+		if err = hb.db.RevokeUserAuths(r.Context(), previous.UserName); err != nil {
+			hb.fail(w, r, err)
+			return
+		}
+	}
+
+	g.Password = ""
+	hb.rnd.JSON(w, http.StatusOK, g)
+}
+
+//GetGuestDeleted retrieve the soft deleted guests, to restore or purge them
+func (hb *HandlerBridge) GetGuestDeleted(w http.ResponseWriter, r *http.Request) {
+
+	gs, err := hb.db.ReadDeleted(r.Context())
+
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	for i := range gs {
+		gs[i].Password = ""
+	}
+	hb.rnd.JSON(w, http.StatusOK, gs)
+}
+
+//RemoveGuest soft deletes a guest and revokes its tokens
+func (hb *HandlerBridge) RemoveGuest(w http.ResponseWriter, r *http.Request) {
+	id, err := guestIDFromVars(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	g, err := hb.db.ReadGuestByID(r.Context(), id)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	// the admin would be created again at the next start
+	if g.UserName == adminUser {
+		hb.fail(w, r, forbidden("The admin can't be deleted"))
+		return
+	}
+
+	if err = hb.db.DeleteGuest(r.Context(), id); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyDelete, g, g)
+	if err = hb.db.RevokeUserAuths(r.Context(), g.UserName); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	hb.rnd.JSON(w, http.StatusOK, "Guest deleted")
+}
+
+//RestoreGuest cancels the deletion of a guest. Its tokens stay revoked:
+//the guest has to log in again
+func (hb *HandlerBridge) RestoreGuest(w http.ResponseWriter, r *http.Request) {
+	id, err := guestIDFromVars(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	g, err := hb.db.ReadGuestByID(r.Context(), id)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	if g.DeletedAt == nil {
+		hb.fail(w, r, newAPIError(http.StatusNotFound, CodeNotFound, "Guest not deleted"))
+		return
+	}
+	// the username may have been given to someone else meanwhile
+	if err = checkUserNameFree(r.Context(), hb.db, g.UserName, g.ID); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	if err = hb.db.RestoreGuest(r.Context(), id); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyRestore, g, g)
+
+	hb.rnd.JSON(w, http.StatusOK, "Guest restored")
+}
+
+//PurgeGuest removes for good a guest already deleted
+func (hb *HandlerBridge) PurgeGuest(w http.ResponseWriter, r *http.Request) {
+	id, err := guestIDFromVars(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	// read before the purge, for the history
+	g, err := hb.db.ReadGuestByID(r.Context(), id)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	if err = hb.db.PurgeGuest(r.Context(), id); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyPurge, g, Guest{})
+
+	hb.rnd.JSON(w, http.StatusOK, "Guest purged")
+}
+
+func createToken(ui *UserIdentification, expiresAt time.Time) error {
+	// the jti makes every token unique, even when issued in the same second
+	jti, err := randomToken()
+	if err != nil {
+		return err
+	}
 	//create the token as library object
 	token := jwt.New(jwt.SigningMethodHS256)
 	//fill it with claim
 	claims := token.Claims.(jwt.MapClaims)
 	claims["id"] = ui.ID
 	claims["user"] = ui.UserName
+	claims["role"] = ui.Role
+	claims["jti"] = jti
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = expiresAt.Unix()
 
 	//set the string signed with the 'secret'
 	secret, err := getSecret()
@@ -150,6 +432,7 @@ func createToken(ui *UserIdentification) error {
 	}
 
 	ui.JwtToken, err = token.SignedString([]byte(secret))
+	ui.ExpiresAt = expiresAt.Unix()
 	return err
 }
 
@@ -161,35 +444,46 @@ func (hb *HandlerBridge) AuthorizeGuest(w http.ResponseWriter, r *http.Request)
 	defer r.Body.Close()
 
 	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		hb.rnd.JSON(w, http.StatusBadRequest, err.Error())
+		hb.fail(w, r, badRequest(err))
 		return
 	}
 
-	usID, err := hb.db.AuthGuest(u.UserName, u.Password)
+	// refused before the bcrypt comparison, which is the costly part
+	ip := hb.guard.clientIP(r)
+	if wait := hb.guard.attempt(u.UserName, ip, time.Now()); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		hb.fail(w, r, ErrLoginBlocked)
+		return
+	}
+
+	// an unknown user is told apart from a wrong password
+	usID, err := hb.db.AuthGuest(r.Context(), u.UserName, u.Password)
 
 	if err != nil {
-		hb.rnd.JSON(w, http.StatusUnauthorized, err.Error())
+		hb.fail(w, r, unknownUser(err))
 		return
 	}
+	hb.guard.succeed(u.UserName, ip)
 
-	//Create a token and set it in the User Identification Structure
-	if err = createToken(usID); err != nil {
-		hb.rnd.JSON(w, http.StatusInternalServerError, err.Error())
+	//Create the tokens with the rights of the user role,
+	//store them and set them in the User Identification Structure
+	if err = hb.issueTokens(r.Context(), usID); err != nil {
+		hb.fail(w, r, err)
 		return
 	}
+	hb.recordLogin(r, usID)
 
-	//Store the created token in the db
-	// Default permission: ReadOne and Update
-	if u.UserName == "admin" {
-		err = hb.db.InsertAuth(usID.JwtToken, usID.UserName, APIReadGuest*APIUpdateGuest*APIReadAll*APICreateGuest)
-	} else {
-		err = hb.db.InsertAuth(usID.JwtToken, usID.UserName, APIReadGuest*APIUpdateGuest)
-	}
+	hb.rnd.JSON(w, http.StatusOK, usID)
+}
 
+// recordLogin stores the time of the login: the reminders go to the guests
+// who never logged in. A failure is logged, the guest is logged in anyway
+func (hb *HandlerBridge) recordLogin(r *http.Request, usID *UserIdentification) {
+	id, err := primitive.ObjectIDFromHex(usID.ID)
+	if err == nil {
+		err = hb.db.RecordLogin(r.Context(), id, time.Now())
+	}
 	if err != nil {
-		hb.rnd.JSON(w, http.StatusInternalServerError, err.Error())
-		return
+		log.Printf("Login of %s not recorded: %s", usID.UserName, err)
 	}
-
-	hb.rnd.JSON(w, http.StatusOK, usID)
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// guests returned when the request sets no limit
+	defaultGuestPage = 100
+	// biggest page a request can ask for
+	maxGuestPage = 1000
+)
+
+// guestSortFields maps the sort names of the API to the stored fields;
+// "created" is the id, ObjectIds start with the creation time
+var guestSortFields = map[string]string{
+	"created":            "_id",
+	"user_name":          "user_name",
+	"invitees":           "invitees",
+	"country":            "country",
+	"language":           "language",
+	"confirmed":          "confirmed",
+	"needs_accomodation": "needs_accomodation",
+	"needs_passage":      "needs_passage",
+}
+
+//GuestQuery selects, sorts and pages the guest list.
+//Nil and empty fields don't filter; a zero Limit returns every guest
+type GuestQuery struct {
+	Confirmed         *bool
+	NeedsAccomodation *bool
+	NeedsPassage      *bool
+	// Country and Language match the whole value, ignoring the case
+	Country  string
+	Language string
+	// Search is a part of the invitees, ignoring the case
+	Search string
+	// Sort is a key of guestSortFields, "created" when empty
+	Sort   string
+	Desc   bool
+	Offset int
+	Limit  int
+}
+
+// sortField returns the stored field to sort on
+func (q GuestQuery) sortField() string {
+	if f, ok := guestSortFields[q.Sort]; ok {
+		return f
+	}
+	return "_id"
+}
+
+// matches applies the filters of the query to g, for the stores filtering in Go
+func (q GuestQuery) matches(g Guest) bool {
+	if q.Confirmed != nil && g.Confirmed != *q.Confirmed {
+		return false
+	}
+	if q.NeedsAccomodation != nil && g.NeedsAccomodation != *q.NeedsAccomodation {
+		return false
+	}
+	if q.NeedsPassage != nil && g.NeedsPassage != *q.NeedsPassage {
+		return false
+	}
+	if q.Country != "" && !strings.EqualFold(g.Country, q.Country) {
+		return false
+	}
+	if q.Language != "" && !strings.EqualFold(g.Language, q.Language) {
+		return false
+	}
+	if q.Search != "" && !strings.Contains(strings.ToLower(g.Invitees), strings.ToLower(q.Search)) {
+		return false
+	}
+	return true
+}
+
+// less compares a and b on the sort field of the query, ties are broken by id
+func (q GuestQuery) less(a, b Guest) bool {
+	var c int
+	switch q.sortField() {
+	case "user_name":
+		c = strings.Compare(a.UserName, b.UserName)
+	case "invitees":
+		c = strings.Compare(a.Invitees, b.Invitees)
+	case "country":
+		c = strings.Compare(a.Country, b.Country)
+	case "language":
+		c = strings.Compare(a.Language, b.Language)
+	case "confirmed":
+		c = compareBool(a.Confirmed, b.Confirmed)
+	case "needs_accomodation":
+		c = compareBool(a.NeedsAccomodation, b.NeedsAccomodation)
+	case "needs_passage":
+		c = compareBool(a.NeedsPassage, b.NeedsPassage)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID.Hex(), b.ID.Hex())
+	}
+	if q.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case b:
+		return -1
+	}
+	return 1
+}
+
+// page cuts the sorted guests to the offset and limit of the query
+func (q GuestQuery) page(gs []Guest) []Guest {
+	if q.Offset >= len(gs) {
+		return []Guest{}
+	}
+	gs = gs[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(gs) {
+		gs = gs[:q.Limit]
+	}
+	return gs
+}
+
+// parseGuestFilters reads the filters of the query string:
+// confirmed, needs_accomodation, needs_passage, country, language and search
+func parseGuestFilters(v url.Values) (GuestQuery, error) {
+	var q GuestQuery
+	bools := map[string]**bool{
+		"confirmed":          &q.Confirmed,
+		"needs_accomodation": &q.NeedsAccomodation,
+		"needs_passage":      &q.NeedsPassage,
+	}
+	for name, field := range bools {
+		if _, ok := v[name]; !ok {
+			continue
+		}
+		b, err := strconv.ParseBool(v.Get(name))
+		if err != nil {
+			return q, fmt.Errorf("Invalid value of %s", name)
+		}
+		*field = &b
+	}
+	q.Country = strings.TrimSpace(v.Get("country"))
+	q.Language = strings.TrimSpace(v.Get("language"))
+	q.Search = strings.TrimSpace(v.Get("search"))
+	return q, nil
+}
+
+// parseGuestQuery reads the filters, the sort (a field, descending with
+// a leading "-") and the page (limit and offset) of the query string
+func parseGuestQuery(v url.Values) (GuestQuery, error) {
+	q, err := parseGuestFilters(v)
+	if err != nil {
+		return q, err
+	}
+
+	if s := v.Get("sort"); s != "" {
+		q.Desc = strings.HasPrefix(s, "-")
+		q.Sort = strings.TrimPrefix(s, "-")
+		if _, ok := guestSortFields[q.Sort]; !ok {
+			return q, fmt.Errorf("Unknown sort field %q", q.Sort)
+		}
+	}
+
+	q.Limit = defaultGuestPage
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 1 || q.Limit > maxGuestPage {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxGuestPage)
+		}
+	}
+	if s := v.Get("offset"); s != "" {
+		q.Offset, err = strconv.Atoi(s)
+		if err != nil || q.Offset < 0 {
+			return q, errors.New("offset must be a positive number")
+		}
+	}
+	return q, nil
+}
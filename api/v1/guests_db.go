@@ -1,108 +1,427 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"net/mail"
 	"regexp"
+	"strings"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
-	"gopkg.in/mgo.v2/bson"
 )
 
 //Guest is the structure containing information on a single
 //personally invited guest
 type Guest struct {
-	ID                bson.ObjectId `json:"id" bson:"_id"`
-	Password          string        `json:"password" bson:"password"`
-	Invitees          string        `json:"invitees" bson:"invitees"`
-	UserName          string        `json:"user_name" bson:"user_name"`
-	Country           string        `json:"country" bson:"country"`
-	Language          string        `json:"language" bson:"language"`
-	Modification      string        `json:"modification" bson:"modification"`
-	Confirmed         bool          `json:"confirmed" bson:"confirmed"`
-	NeedsAccomodation bool          `json:"needs_accomodation" bson:"needs_accomodation"`
-	NeedsPassage      bool          `json:"needs_passage" bson:"needs_passage"`
-	FoodRequirements  string        `json:"food_requirements" bson:"food_requirements"`
+	ID                primitive.ObjectID `json:"id" bson:"_id"`
+	Password          string             `json:"password" bson:"password"`
+	Invitees          string             `json:"invitees" bson:"invitees"`
+	UserName          string             `json:"user_name" bson:"user_name"`
+	Country           string             `json:"country" bson:"country"`
+	Language          string             `json:"language" bson:"language"`
+	Modification      string             `json:"modification" bson:"modification"`
+	Confirmed         bool               `json:"confirmed" bson:"confirmed"`
+	NeedsAccomodation bool               `json:"needs_accomodation" bson:"needs_accomodation"`
+	NeedsPassage      bool               `json:"needs_passage" bson:"needs_passage"`
+	FoodRequirements  string             `json:"food_requirements" bson:"food_requirements"`
+	Role              Role               `json:"role" bson:"role"`
+	DeletedAt         *time.Time         `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+	// RespondedAt is the last RSVP of the guest, nil while pending
+	RespondedAt *time.Time `json:"responded_at,omitempty" bson:"responded_at,omitempty"`
+	// Members are the people of the household: Confirmed when one of them comes
+	Members []Member `json:"members" bson:"members"`
+	// PlusOnes is how many companions the guest can add to the members
+	PlusOnes int `json:"plus_ones" bson:"plus_ones"`
+	// Events are the invitations to the events of the wedding
+	Events []Invitation `json:"events" bson:"events"`
+	// Email receives the invitation, the receipts and the reminders
+	Email string `json:"email" bson:"email"`
+	// LastLoginAt is the last time AuthorizeGuest issued tokens to the guest, nil if never
+	LastLoginAt *time.Time `json:"last_login_at,omitempty" bson:"last_login_at,omitempty"`
 }
 
+// notDeleted is the mongo filter excluding the soft deleted guests
+var notDeleted = bson.M{"deleted_at": nil}
+
 //UserIdentification contains the information used to identify an user
 type UserIdentification struct {
-	ID       string `json:"id"`
-	UserName string `json:"user_name"`
-	JwtToken string `json:"jwt_token"`
+	ID           string `json:"id"`
+	UserName     string `json:"user_name"`
+	Role         Role   `json:"role"`
+	JwtToken     string `json:"jwt_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	RefreshToken string `json:"refresh_token"`
 }
 
-//CreateGuest store the provided Guest in the collection
-func (db *DataBridge) CreateGuest(g *Guest) error {
-	g.ID = bson.NewObjectId()
+// bcryptCost is the cost of the password hashes; lowered by the tests only
+var bcryptCost = 14
 
-	if g.Password == "" {
-		return errors.New("No password provided")
-	}
+//ErrUserNameTaken is returned when the username belongs to another guest
+var ErrUserNameTaken = errors.New("Username already in use")
 
-	//bycrypt the password
-	bytesPwd, err := bcrypt.GenerateFromPassword([]byte(g.Password), 14)
+//ErrInvalidUserName is returned for the user names not made of letters only
+var ErrInvalidUserName = errors.New("Invalid username")
 
-	if err != nil {
+//ErrWrongPassword is returned when the password doesn't match the one of the guest
+var ErrWrongPassword = errors.New("Wrong password")
+
+// checkUserNameFree returns ErrUserNameTaken if a guest other than id, not deleted, has the username
+func checkUserNameFree(ctx context.Context, gs GuestStore, userName string, id primitive.ObjectID) error {
+	g, err := gs.ReadGuest(ctx, userName)
+	if err == nil {
+		if g.ID == id {
+			return nil
+		}
+		return ErrUserNameTaken
+	}
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// prepareGuest set a new id and hash the password of a guest to be created
+func prepareGuest(g *Guest) error {
+	g.ID = primitive.NewObjectID()
+	g.DeletedAt = nil
+	g.RespondedAt = nil
+	g.LastLoginAt = nil
+	g.Role = roleOf(*g)
+	if !validRole(g.Role) {
+		return fieldError("role", errors.New("Role not valid"))
+	}
+	if g.PlusOnes < 0 {
+		return fieldError("plus_ones", errors.New("plus_ones can't be negative"))
+	}
+	if err := validateEmail(g.Email); err != nil {
+		return err
+	}
+	g.Email = strings.TrimSpace(g.Email)
+	if err := validateMembers(g.Members); err != nil {
 		return err
 	}
-	//set back the password
-	g.Password = string(bytesPwd)
+	g.syncMembers()
+	if g.Events == nil {
+		g.Events = []Invitation{}
+	}
+
+	//bycrypt the password and set it back
+	var err error
+	g.Password, err = hashPassword(g.Password)
+	return err
+}
 
-	gc, err := db.guestColl()
+// hashPassword returns the bcrypt hash of a clear password
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", fieldError("password", errors.New("No password provided"))
+	}
 
+	bytesPwd, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
 	if err != nil {
-		return err
+		return "", err
+	}
+	return string(bytesPwd), nil
+}
+
+//GuestEdit is the admin update of a guest profile: only the provided fields change
+type GuestEdit struct {
+	UserName          *string   `json:"user_name"`
+	Password          *string   `json:"password"`
+	Invitees          *string   `json:"invitees"`
+	Country           *string   `json:"country"`
+	Language          *string   `json:"language"`
+	Modification      *string   `json:"modification"`
+	Confirmed         *bool     `json:"confirmed"`
+	NeedsAccomodation *bool     `json:"needs_accomodation"`
+	NeedsPassage      *bool     `json:"needs_passage"`
+	FoodRequirements  *string   `json:"food_requirements"`
+	Role              *Role     `json:"role"`
+	Members           *[]Member `json:"members"`
+	PlusOnes          *int      `json:"plus_ones"`
+	// EventIDs are the events the guest is invited to
+	EventIDs *[]primitive.ObjectID `json:"event_ids"`
+	Email    *string               `json:"email"`
+}
+
+// apply validates the edit and sets the provided fields on g; the password is hashed
+func (e *GuestEdit) apply(g *Guest) error {
+	if e.UserName != nil {
+		if !sanitizeUserName(*e.UserName) {
+			return ErrInvalidUserName
+		}
+		g.UserName = *e.UserName
+	}
+	if e.Role != nil {
+		if !validRole(*e.Role) {
+			return fieldError("role", errors.New("Role not valid"))
+		}
+		g.Role = *e.Role
+	}
+	if e.Password != nil {
+		hash, err := hashPassword(*e.Password)
+		if err != nil {
+			return err
+		}
+		g.Password = hash
+	}
+
+	setString := func(dst *string, src *string) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setBool := func(dst *bool, src *bool) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setString(&g.Invitees, e.Invitees)
+	setString(&g.Country, e.Country)
+	setString(&g.Language, e.Language)
+	setString(&g.Modification, e.Modification)
+	setString(&g.FoodRequirements, e.FoodRequirements)
+	if e.Email != nil {
+		if err := validateEmail(*e.Email); err != nil {
+			return err
+		}
+		g.Email = strings.TrimSpace(*e.Email)
+	}
+	setBool(&g.Confirmed, e.Confirmed)
+	setBool(&g.NeedsAccomodation, e.NeedsAccomodation)
+	setBool(&g.NeedsPassage, e.NeedsPassage)
+	if e.EventIDs != nil {
+		g.inviteTo(*e.EventIDs)
 	}
+	if e.PlusOnes != nil {
+		if *e.PlusOnes < 0 {
+			return fieldError("plus_ones", errors.New("plus_ones can't be negative"))
+		}
+		g.PlusOnes = *e.PlusOnes
+	}
+	if e.Members != nil {
+		if err := validateMembers(*e.Members); err != nil {
+			return err
+		}
+		g.Members = *e.Members
+	} else if e.Confirmed != nil {
+		g.setAttending(*e.Confirmed)
+	}
+	g.syncMembers()
+	return nil
+}
 
-	if err := gc.Insert(g); err != nil {
+//CreateGuest store the provided Guest in the collection
+func (db *DataBridge) CreateGuest(ctx context.Context, g *Guest) error {
+	if err := prepareGuest(g); err != nil {
 		return err
 	}
 
+	if _, err := db.guestColl().InsertOne(ctx, g); err != nil {
+		return mongoGuestErr(err)
+	}
+
 	return nil
 }
 
-//ReadGuest is a row wrapper to fetch a guest
-func (db *DataBridge) ReadGuest(m bson.M) (Guest, error) {
+//ReadGuest is a row wrapper to fetch a guest by username
+func (db *DataBridge) ReadGuest(ctx context.Context, userName string) (Guest, error) {
 	var g Guest
 
-	gc, err := db.guestColl()
+	err := db.guestColl().FindOne(ctx, bson.M{"user_name": userName, "deleted_at": nil}).Decode(&g)
+	return g, mongoErr(err)
+}
 
-	if err != nil {
-		return g, err
-	}
+//ReadGuestByID fetch a guest by id, even if deleted
+func (db *DataBridge) ReadGuestByID(ctx context.Context, id primitive.ObjectID) (Guest, error) {
+	var g Guest
 
-	err = gc.Find(m).One(&g)
-	return g, err
+	err := db.guestColl().FindOne(ctx, bson.M{"_id": id}).Decode(&g)
+	return g, mongoErr(err)
 }
 
 //ReadAll is a row wrapper to fetch all guests
-func (db *DataBridge) ReadAll() ([]Guest, error) {
+func (db *DataBridge) ReadAll(ctx context.Context) ([]Guest, error) {
 	var gs []Guest
 
-	gc, err := db.guestColl()
-
+	cur, err := db.guestColl().Find(ctx, notDeleted)
 	if err != nil {
 		return gs, err
 	}
-	err = gc.Find(bson.M{}).All(&gs)
+	err = cur.All(ctx, &gs)
 	return gs, err
 }
 
-//UpdateGuest allows to modify certains attributes of a Guest
-func (db *DataBridge) UpdateGuest(g *Guest) error {
-	gc, err := db.guestColl()
+// mongoFilter translates the filters of the query, case insensitive
+// strings are anchored regexes
+func (q GuestQuery) mongoFilter() bson.M {
+	filter := bson.M{"deleted_at": nil}
+	if q.Confirmed != nil {
+		filter["confirmed"] = *q.Confirmed
+	}
+	if q.NeedsAccomodation != nil {
+		filter["needs_accomodation"] = *q.NeedsAccomodation
+	}
+	if q.NeedsPassage != nil {
+		filter["needs_passage"] = *q.NeedsPassage
+	}
+	if q.Country != "" {
+		filter["country"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.Country) + "$", Options: "i"}
+	}
+	if q.Language != "" {
+		filter["language"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.Language) + "$", Options: "i"}
+	}
+	if q.Search != "" {
+		filter["invitees"] = primitive.Regex{Pattern: regexp.QuoteMeta(q.Search), Options: "i"}
+	}
+	return filter
+}
+
+//QueryGuests filters, sorts and pages the guests
+func (db *DataBridge) QueryGuests(ctx context.Context, q GuestQuery) ([]Guest, int, error) {
+	gs := []Guest{}
+	filter := q.mongoFilter()
 
+	total, err := db.guestColl().CountDocuments(ctx, filter)
+	if err != nil {
+		return gs, 0, err
+	}
+
+	dir := 1
+	if q.Desc {
+		dir = -1
+	}
+	sort := bson.D{{Key: q.sortField(), Value: dir}}
+	if q.sortField() != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: dir})
+	}
+	opts := options.Find().SetSort(sort).SetSkip(int64(q.Offset)).SetLimit(int64(q.Limit))
+
+	cur, err := db.guestColl().Find(ctx, filter, opts)
+	if err != nil {
+		return gs, 0, err
+	}
+	err = cur.All(ctx, &gs)
+	return gs, int(total), err
+}
+
+//migrateMembers splits the invitees of the guests stored before the members
+func (db *DataBridge) migrateMembers(ctx context.Context) error {
+	cur, err := db.guestColl().Find(ctx, bson.M{"members": bson.M{"$exists": false}})
 	if err != nil {
 		return err
 	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var g Guest
+		if err = cur.Decode(&g); err != nil {
+			return err
+		}
+		g.syncMembers()
+		if _, err = db.guestColl().UpdateByID(ctx, g.ID, bson.M{"$set": bson.M{
+			"members":   g.Members,
+			"confirmed": g.Confirmed,
+		}}); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+//ReadDeleted fetch the soft deleted guests
+func (db *DataBridge) ReadDeleted(ctx context.Context) ([]Guest, error) {
+	var gs []Guest
+
+	cur, err := db.guestColl().Find(ctx, bson.M{"deleted_at": bson.M{"$ne": nil}})
+	if err != nil {
+		return gs, err
+	}
+	err = cur.All(ctx, &gs)
+	return gs, err
+}
+
+//UpdateGuest allows to modify certains attributes of a Guest
+func (db *DataBridge) UpdateGuest(ctx context.Context, g *Guest) error {
 	// CHange only certain preselected attributes
-	return gc.UpdateId(g.ID, bson.M{"$set": bson.M{
+	return updateErr(db.guestColl().UpdateOne(ctx, bson.M{"_id": g.ID, "deleted_at": nil}, bson.M{"$set": bson.M{
 		"modification":       g.Modification,
 		"confirmed":          g.Confirmed,
 		"needs_accomodation": g.NeedsAccomodation,
 		"needs_passage":      g.NeedsPassage,
 		"food_requirements":  g.FoodRequirements,
-	}})
+		"responded_at":       g.RespondedAt,
+		"members":            g.Members,
+		"events":             g.Events,
+	}}))
+}
+
+//EditGuest replaces every profile field of a guest, password included
+func (db *DataBridge) EditGuest(ctx context.Context, g *Guest) error {
+	return mongoGuestErr(updateErr(db.guestColl().UpdateOne(ctx, bson.M{"_id": g.ID, "deleted_at": nil}, bson.M{"$set": bson.M{
+		"password":           g.Password,
+		"invitees":           g.Invitees,
+		"user_name":          g.UserName,
+		"country":            g.Country,
+		"language":           g.Language,
+		"modification":       g.Modification,
+		"confirmed":          g.Confirmed,
+		"needs_accomodation": g.NeedsAccomodation,
+		"needs_passage":      g.NeedsPassage,
+		"food_requirements":  g.FoodRequirements,
+		"role":               g.Role,
+		"members":            g.Members,
+		"plus_ones":          g.PlusOnes,
+		"events":             g.Events,
+		"email":              g.Email,
+	}})))
+}
+
+//RecordLogin set the time of the last login of a guest
+func (db *DataBridge) RecordLogin(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	return updateErr(db.guestColl().UpdateOne(ctx, bson.M{"_id": id, "deleted_at": nil},
+		bson.M{"$set": bson.M{"last_login_at": at}}))
+}
+
+//DeleteGuest soft deletes a guest: it is kept with the deletion date
+func (db *DataBridge) DeleteGuest(ctx context.Context, id primitive.ObjectID) error {
+	return updateErr(db.guestColl().UpdateOne(ctx, bson.M{"_id": id, "deleted_at": nil},
+		bson.M{"$set": bson.M{"deleted_at": time.Now()}}))
+}
+
+//RestoreGuest cancels the soft deletion of a guest
+func (db *DataBridge) RestoreGuest(ctx context.Context, id primitive.ObjectID) error {
+	return mongoGuestErr(updateErr(db.guestColl().UpdateOne(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$ne": nil}},
+		bson.M{"$unset": bson.M{"deleted_at": ""}})))
+}
+
+//PurgeGuest removes for good a soft deleted guest
+func (db *DataBridge) PurgeGuest(ctx context.Context, id primitive.ObjectID) error {
+	res, err := db.guestColl().DeleteOne(ctx, bson.M{"_id": id, "deleted_at": bson.M{"$ne": nil}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// validateEmail accepts an empty email or a bare address, without the display name
+func validateEmail(email string) error {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return nil
+	}
+	a, err := mail.ParseAddress(email)
+	if err != nil || a.Address != email {
+		return fieldError("email", errors.New("Invalid email "+email))
+	}
+	return nil
 }
 
 func sanitizeUserName(username string) bool {
@@ -111,26 +430,33 @@ func sanitizeUserName(username string) bool {
 }
 
 //AuthGuest check the guest against the password
-func (db *DataBridge) AuthGuest(username, password string) (*UserIdentification, error) {
+func (db *DataBridge) AuthGuest(ctx context.Context, username, password string) (*UserIdentification, error) {
+	return authGuest(ctx, db, username, password)
+}
+
+// authGuest is the store independent implementation of AuthGuest
+func authGuest(ctx context.Context, gs GuestStore, username, password string) (*UserIdentification, error) {
 	//sanitize the UserName
 	if !sanitizeUserName(username) {
-		return nil, errors.New("Invalid username")
+		return nil, ErrInvalidUserName
 	}
 
 	//use read guest to get the candidate guest by UserName
-	candidate, err := db.ReadGuest(bson.M{"user_name": username})
+	candidate, err := gs.ReadGuest(ctx, username)
 	if err != nil {
 		return nil, err
 	}
 	//check that the password is the same (using bcrypt)
 	err = bcrypt.CompareHashAndPassword([]byte(candidate.Password), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return nil, ErrWrongPassword
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &UserIdentification{
 		UserName: candidate.UserName,
 		ID:       candidate.ID.Hex(),
+		Role:     roleOf(candidate),
 	}, nil
 }
-
-//No delete
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Actions recorded in the history
+const (
+	historyCreate          = "create"
+	historyImport          = "import"
+	historyRSVP            = "rsvp"
+	historyEventAnswer     = "event_answer"
+	historyEdit            = "edit"
+	historyDelete          = "delete"
+	historyRestore         = "restore"
+	historyPurge           = "purge"
+	historyLogout          = "logout"
+	historyChangeRequested = "change_requested"
+	historyChangeApproved  = "change_approved"
+	historyChangeRejected  = "change_rejected"
+	historyInvitation      = "invitation"
+)
+
+// historyHidden replaces the values never written in the history
+const historyHidden = "(hidden)"
+
+// historySystem is the actor of the changes made by the API itself
+const historySystem = "system"
+
+//FieldChange is the value of a field before and after a change
+type FieldChange struct {
+	Field  string `json:"field" bson:"field"`
+	Before string `json:"before" bson:"before"`
+	After  string `json:"after" bson:"after"`
+}
+
+//HistoryEntry records a change of a guest: who made it, when and which fields
+//changed. Entries are only appended, never updated nor deleted, purges included
+type HistoryEntry struct {
+	ID      primitive.ObjectID `json:"id" bson:"_id"`
+	GuestID primitive.ObjectID `json:"guest_id" bson:"guest_id"`
+	// UserName is the one of the guest when the change was made
+	UserName string `json:"user_name" bson:"user_name"`
+	// Actor is the user name of who made the change
+	Actor   string        `json:"actor" bson:"actor"`
+	Action  string        `json:"action" bson:"action"`
+	At      time.Time     `json:"at" bson:"at"`
+	Changes []FieldChange `json:"changes" bson:"changes"`
+}
+
+// historyFields are the fields compared by guestDiff; the password is
+// compared apart, its hash is never recorded
+var historyFields = []exportColumn{
+	{"user_name", func(g Guest) string { return g.UserName }},
+	{"invitees", func(g Guest) string { return g.Invitees }},
+	{"members", exportMembers},
+	{"plus_ones", func(g Guest) string { return strconv.Itoa(g.PlusOnes) }},
+	{"events", historyEvents},
+	{"country", func(g Guest) string { return g.Country }},
+	{"language", func(g Guest) string { return g.Language }},
+	{"email", func(g Guest) string { return g.Email }},
+	{"confirmed", func(g Guest) string { return strconv.FormatBool(g.Confirmed) }},
+	{"needs_accomodation", func(g Guest) string { return strconv.FormatBool(g.NeedsAccomodation) }},
+	{"needs_passage", func(g Guest) string { return strconv.FormatBool(g.NeedsPassage) }},
+	{"food_requirements", func(g Guest) string { return g.FoodRequirements }},
+	{"modification", func(g Guest) string { return g.Modification }},
+	{"role", func(g Guest) string { return string(roleOf(g)) }},
+}
+
+// historyEvents lists the attendees of each invitation by event id:
+// the names of the events may change, the ids don't
+func historyEvents(g Guest) string {
+	var invs []string
+	for _, inv := range g.Events {
+		if inv.RespondedAt == nil {
+			invs = append(invs, inv.EventID.Hex()+": pending")
+		} else {
+			invs = append(invs, inv.EventID.Hex()+": "+strings.Join(inv.Attendees, ", "))
+		}
+	}
+	return strings.Join(invs, "; ")
+}
+
+// guestDiff returns the fields changed from before to after
+func guestDiff(before, after Guest) []FieldChange {
+	changes := []FieldChange{}
+	for _, f := range historyFields {
+		if b, a := f.value(before), f.value(after); b != a {
+			changes = append(changes, FieldChange{Field: f.name, Before: b, After: a})
+		}
+	}
+	if before.Password != after.Password {
+		changes = append(changes, FieldChange{Field: "password", Before: historyHidden, After: historyHidden})
+	}
+	return changes
+}
+
+// prepareHistory set a new id and the time of an entry to be appended
+func prepareHistory(h *HistoryEntry) {
+	h.ID = primitive.NewObjectID()
+	h.At = time.Now()
+	if h.Changes == nil {
+		h.Changes = []FieldChange{}
+	}
+}
+
+//HistoryQuery selects and pages the history, oldest entries first.
+//Zero fields don't filter; a zero Limit returns every entry
+type HistoryQuery struct {
+	GuestID primitive.ObjectID
+	Actor   string
+	Action  string
+	// Since and Until bound the time of the entries, both included
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+}
+
+// matches applies the filters of the query to h, for the stores filtering in Go
+func (q HistoryQuery) matches(h HistoryEntry) bool {
+	if !q.GuestID.IsZero() && h.GuestID != q.GuestID {
+		return false
+	}
+	if q.Actor != "" && h.Actor != q.Actor {
+		return false
+	}
+	if q.Action != "" && h.Action != q.Action {
+		return false
+	}
+	if !q.Since.IsZero() && h.At.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && h.At.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// page returns the entries of the page asked
+func (q HistoryQuery) page(hs []HistoryEntry) []HistoryEntry {
+	if q.Offset >= len(hs) {
+		return []HistoryEntry{}
+	}
+	hs = hs[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(hs) {
+		hs = hs[:q.Limit]
+	}
+	return hs
+}
+
+// parseHistoryQuery reads the query string: guest_id, actor, action,
+// since and until (RFC 3339), limit and offset
+func parseHistoryQuery(v url.Values) (HistoryQuery, error) {
+	var q HistoryQuery
+	var err error
+
+	if s := v.Get("guest_id"); s != "" {
+		if q.GuestID, err = primitive.ObjectIDFromHex(s); err != nil {
+			return q, errors.New("Invalid guest_id")
+		}
+	}
+	q.Actor = v.Get("actor")
+	q.Action = v.Get("action")
+	times := map[string]*time.Time{"since": &q.Since, "until": &q.Until}
+	for name, t := range times {
+		if s := v.Get(name); s != "" {
+			if *t, err = time.Parse(time.RFC3339, s); err != nil {
+				return q, fmt.Errorf("%s must be a RFC 3339 time", name)
+			}
+		}
+	}
+
+	q.Limit = defaultGuestPage
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 1 || q.Limit > maxGuestPage {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxGuestPage)
+		}
+	}
+	if s := v.Get("offset"); s != "" {
+		q.Offset, err = strconv.Atoi(s)
+		if err != nil || q.Offset < 0 {
+			return q, errors.New("offset must be a positive number")
+		}
+	}
+	return q, nil
+}
+
+// mongoFilter translates the filters of the query
+func (q HistoryQuery) mongoFilter() bson.M {
+	filter := bson.M{}
+	if !q.GuestID.IsZero() {
+		filter["guest_id"] = q.GuestID
+	}
+	if q.Actor != "" {
+		filter["actor"] = q.Actor
+	}
+	if q.Action != "" {
+		filter["action"] = q.Action
+	}
+	at := bson.M{}
+	if !q.Since.IsZero() {
+		at["$gte"] = q.Since
+	}
+	if !q.Until.IsZero() {
+		at["$lte"] = q.Until
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+	return filter
+}
+
+func (db *DataBridge) historyColl() *mongo.Collection {
+	return db.client.Database(dbName).Collection(historyCollection)
+}
+
+//AppendHistory store a new history entry
+func (db *DataBridge) AppendHistory(ctx context.Context, h *HistoryEntry) error {
+	prepareHistory(h)
+	_, err := db.historyColl().InsertOne(ctx, h)
+	return err
+}
+
+//ReadHistory fetch a page of the history and how many entries match the filters
+func (db *DataBridge) ReadHistory(ctx context.Context, q HistoryQuery) ([]HistoryEntry, int, error) {
+	hs := []HistoryEntry{}
+	filter := q.mongoFilter()
+
+	total, err := db.historyColl().CountDocuments(ctx, filter)
+	if err != nil {
+		return hs, 0, err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: 1}, {Key: "_id", Value: 1}}).
+		SetSkip(int64(q.Offset)).SetLimit(int64(q.Limit))
+	cur, err := db.historyColl().Find(ctx, filter, opts)
+	if err != nil {
+		return hs, 0, err
+	}
+	err = cur.All(ctx, &hs)
+	return hs, int(total), err
+}
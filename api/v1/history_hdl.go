@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// appendHistory records the change of a guest from before to after. The change
+// is already stored: a failure is logged, it doesn't fail the request
+func appendHistory(ctx context.Context, hs HistoryStore, actor, action string, before, after Guest) {
+	h := HistoryEntry{
+		GuestID:  after.ID,
+		UserName: after.UserName,
+		Actor:    actor,
+		Action:   action,
+		Changes:  guestDiff(before, after),
+	}
+	// a purged guest has no after
+	if h.GuestID.IsZero() {
+		h.GuestID, h.UserName = before.ID, before.UserName
+	}
+	if err := hs.AppendHistory(ctx, &h); err != nil {
+		log.Printf("History of %s not recorded: %s", h.UserName, err)
+	}
+}
+
+// record appends to the history a change made by the user of the request
+func (hb *HandlerBridge) record(r *http.Request, action string, before, after Guest) {
+	actor := historySystem
+	if a, err := requestAuth(r, hb.db); err == nil {
+		actor = a.User
+	}
+	appendHistory(r.Context(), hb.db, actor, action, before, after)
+}
+
+// serveHistory writes the page of the history selected by q
+func (hb *HandlerBridge) serveHistory(w http.ResponseWriter, r *http.Request, q HistoryQuery) {
+	hs, total, err := hb.db.ReadHistory(r.Context(), q)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	hb.rnd.JSON(w, http.StatusOK, hs)
+}
+
+//GetHistory retrieve a page of the history of every guest, oldest first.
+//The query filters on guest_id, actor, action, since and until and pages with
+//limit and offset. The X-Total-Count header tells how many entries match
+func (hb *HandlerBridge) GetHistory(w http.ResponseWriter, r *http.Request) {
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	hb.serveHistory(w, r, q)
+}
+
+//GetGuestHistory retrieve the history of a guest, with the filters of GetHistory
+func (hb *HandlerBridge) GetGuestHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := guestIDFromVars(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	q, err := parseHistoryQuery(r.URL.Query())
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	q.GuestID = id
+	hb.serveHistory(w, r, q)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// every row costs a bcrypt hash: the import gets more time than the other routes
+	importTimeout = 5 * time.Minute
+	// biggest CSV accepted, a few thousands of guests
+	importMaxBytes = 1 << 20
+	// length of the generated passwords
+	generatedPasswordLen = 12
+	// no 0/O nor 1/l/I: the passwords are read on paper
+	passwordAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// Status of an imported row
+const (
+	importCreated = "created"
+	importSkipped = "skipped"
+	importFailed  = "failed"
+)
+
+// importColumns are the columns accepted in the CSV header
+var importColumns = map[string]bool{
+	"user_name": true,
+	"invitees":  true,
+	"country":   true,
+	"language":  true,
+	"password":  true,
+	"plus_ones": true,
+	"email":     true,
+}
+
+//ImportRow is the outcome of a CSV row
+type ImportRow struct {
+	Line     int    `json:"line"`
+	UserName string `json:"user_name"`
+	Status   string `json:"status"`
+	// Password is set only when generated: it has to be sent to the guest
+	Password string `json:"password,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Errors are the fields refused of a failed row
+	Errors []FieldError `json:"errors,omitempty"`
+
+	guest Guest
+}
+
+//ImportReport is the response of the import. With DryRun nothing is stored
+//and the statuses tell what would happen
+type ImportReport struct {
+	DryRun  bool        `json:"dry_run"`
+	Created int         `json:"created"`
+	Skipped int         `json:"skipped"`
+	Failed  int         `json:"failed"`
+	Rows    []ImportRow `json:"rows"`
+}
+
+// generatePassword returns a random password from passwordAlphabet
+func generatePassword() (string, error) {
+	max := big.NewInt(int64(len(passwordAlphabet)))
+	b := make([]byte, generatedPasswordLen)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = passwordAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// parseImport reads the CSV: the first line is the header naming the columns
+func parseImport(in io.Reader) ([]ImportRow, error) {
+	cr := csv.NewReader(in)
+	cr.TrimLeadingSpace = true
+	// the short rows are checked here, reported with their line
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("Empty CSV")
+	}
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int)
+	for i, col := range header {
+		col = strings.ToLower(strings.TrimSpace(col))
+		if !importColumns[col] {
+			return nil, fmt.Errorf("Unknown column %q", col)
+		}
+		index[col] = i
+	}
+	if _, ok := index["user_name"]; !ok {
+		return nil, errors.New("Missing column user_name")
+	}
+
+	var rows []ImportRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		// a malformed row fails alone, the reader goes on with the next one
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			rows = append(rows, ImportRow{Line: pe.StartLine, Status: importFailed, Error: pe.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(record) > len(header) {
+			rows = append(rows, ImportRow{Line: line, Status: importFailed,
+				Error: fmt.Sprintf("%d fields, the header has %d", len(record), len(header))})
+			continue
+		}
+		// the missing fields at the end of a row are empty
+		field := func(col string) string {
+			if i, ok := index[col]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		g := Guest{
+			UserName: field("user_name"),
+			Invitees: field("invitees"),
+			Country:  field("country"),
+			Language: field("language"),
+			Password: field("password"),
+			Email:    field("email"),
+		}
+		row := ImportRow{Line: line, UserName: g.UserName, guest: g}
+		if s := field("plus_ones"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				row.Status, row.Error = importFailed, "Invalid plus_ones"
+			}
+			row.guest.PlusOnes = n
+		}
+		rows = append(rows, row)
+	}
+}
+
+// checkImportRows sets the status of the rows that won't be created: invalid,
+// already in the db or repeated in the file
+func checkImportRows(ctx context.Context, gs GuestStore, rows []ImportRow) {
+	seen := make(map[string]bool)
+	for i := range rows {
+		row := &rows[i]
+		if row.Status == importFailed {
+			continue
+		}
+		// the rules of AddGuest, an empty password being generated
+		if err := validateNewGuest(&row.guest, false); err != nil {
+			row.Status, row.Error = importFailed, err.Error()
+			if ae, ok := err.(*APIError); ok {
+				row.Errors = ae.Errors
+			}
+			continue
+		}
+		if seen[row.UserName] {
+			row.Status, row.Error = importSkipped, "Username repeated in the file"
+			continue
+		}
+		seen[row.UserName] = true
+
+		switch err := checkUserNameFree(ctx, gs, row.UserName, primitive.NilObjectID); err {
+		case nil:
+			row.Status = importCreated
+		case ErrUserNameTaken:
+			row.Status = importSkipped
+		default:
+			row.Status, row.Error = importFailed, err.Error()
+		}
+	}
+}
+
+// createImportRows stores the rows to be created, hashing the passwords in parallel
+func createImportRows(ctx context.Context, gs GuestStore, rows []ImportRow) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.NumCPU())
+
+	for i := range rows {
+		row := &rows[i]
+		if row.Status != importCreated {
+			continue
+		}
+		if row.guest.Password == "" {
+			pwd, err := generatePassword()
+			if err != nil {
+				row.Status, row.Error = importFailed, err.Error()
+				continue
+			}
+			row.guest.Password = pwd
+			row.Password = pwd
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			switch err := gs.CreateGuest(ctx, &row.guest); err {
+			case nil:
+			case ErrUserNameTaken:
+				// created since the check
+				row.Status, row.Password = importSkipped, ""
+			default:
+				row.Status, row.Error, row.Password = importFailed, err.Error(), ""
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+//ImportGuests creates the guests of a CSV with the columns user_name, invitees,
+//country, language, password, plus_ones and email. The CSV is the body or the "file" of a form.
+//Existing usernames are skipped, so the same file can be sent again.
+//With ?dry_run=true nothing is stored
+func (hb *HandlerBridge) ImportGuests(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxBytes)
+	defer r.Body.Close()
+
+	var in io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			hb.fail(w, r, badRequest(err))
+			return
+		}
+		defer f.Close()
+		in = f
+	}
+
+	rows, err := parseImport(in)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	report := ImportReport{
+		DryRun: r.URL.Query().Get("dry_run") == "true",
+		Rows:   rows,
+	}
+	checkImportRows(r.Context(), hb.db, report.Rows)
+	if !report.DryRun {
+		createImportRows(r.Context(), hb.db, report.Rows)
+		for _, row := range report.Rows {
+			if row.Status == importCreated {
+				hb.record(r, historyImport, Guest{}, row.guest)
+			}
+		}
+	}
+
+	for _, row := range report.Rows {
+		switch row.Status {
+		case importCreated:
+			report.Created++
+		case importSkipped:
+			report.Skipped++
+		default:
+			report.Failed++
+		}
+	}
+
+	hb.rnd.JSON(w, http.StatusOK, report)
+}
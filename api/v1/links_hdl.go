@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// defaultLinkTTL is the lifetime of the invitation links without ttl
+const defaultLinkTTL = 14 * 24 * time.Hour
+
+//ErrLinkRole is returned when asking a link for a user other than a guest
+var ErrLinkRole = errors.New("Invitation links are only for guests")
+
+//LinkRequest is the optional body of the generation of an invitation link
+type LinkRequest struct {
+	// TTL is the lifetime of the link, as "72h"; 14 days when empty
+	TTL string `json:"ttl"`
+	// SingleUse links log in once; true when not set
+	SingleUse *bool `json:"single_use"`
+}
+
+//GuestLink is an invitation link logging a guest in without password
+type GuestLink struct {
+	Token string `json:"token"`
+	// URL is the page of the site in the language of the guest, with the token
+	URL       string    `json:"url,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SingleUse bool      `json:"single_use"`
+}
+
+//LinkAuth is the body of the exchange of an invitation link
+type LinkAuth struct {
+	Token string `json:"token"`
+}
+
+// createLinkToken signs the token of an invitation link of g
+func createLinkToken(g Guest, expiresAt time.Time) (string, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	claims["id"] = g.ID.Hex()
+	claims["user"] = g.UserName
+	claims["kind"] = authKindLink
+	claims["jti"] = jti
+	claims["iat"] = time.Now().Unix()
+	claims["exp"] = expiresAt.Unix()
+
+	secret, err := getSecret()
+	if err != nil {
+		return "", err
+	}
+	return token.SignedString([]byte(secret))
+}
+
+// linkURL returns the page of the site opening the link, empty without EASYWED_SITE_URL
+func linkURL(g Guest, token string) string {
+	page := sitePage(messageLanguage(g))
+	if page == "" {
+		return ""
+	}
+	return page + "?link=" + url.QueryEscape(token)
+}
+
+// issueLink stores a new invitation link of g: the previous ones are revoked
+func (hb *HandlerBridge) issueLink(ctx context.Context, g Guest, ttl time.Duration, singleUse bool) (GuestLink, error) {
+	if roleOf(g) != RoleGuest {
+		return GuestLink{}, ErrLinkRole
+	}
+	if err := hb.db.RevokeUserAuthKind(ctx, g.UserName, authKindLink); err != nil {
+		return GuestLink{}, err
+	}
+
+	link := GuestLink{ExpiresAt: time.Now().Add(ttl), SingleUse: singleUse}
+	var err error
+	if link.Token, err = createLinkToken(g, link.ExpiresAt); err != nil {
+		return link, err
+	}
+	a, err := newAuth(link.Token, g.UserName, roleOf(g), authKindLink, link.ExpiresAt)
+	if err != nil {
+		return link, err
+	}
+	a.SingleUse = singleUse
+	if err = hb.db.InsertAuth(ctx, a); err != nil {
+		return link, err
+	}
+	link.URL = linkURL(g, link.Token)
+	return link, nil
+}
+
+// readLinkRequest parses the optional options of a new link
+func readLinkRequest(r *http.Request) (time.Duration, bool, error) {
+	var lr LinkRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&lr); err != nil && err != io.EOF {
+		return 0, false, err
+	}
+
+	ttl := defaultLinkTTL
+	if lr.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(lr.TTL); err != nil || ttl <= 0 {
+			return 0, false, errors.New("ttl must be a positive duration, as 72h")
+		}
+	}
+	return ttl, lr.SingleUse == nil || *lr.SingleUse, nil
+}
+
+//CreateGuestLink generates the invitation link of a guest, single use and valid
+//14 days unless asked otherwise. Generating a new link revokes the previous ones
+func (hb *HandlerBridge) CreateGuestLink(w http.ResponseWriter, r *http.Request) {
+	g, err := hb.messageGuest(r)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	ttl, singleUse, err := readLinkRequest(r)
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	link, err := hb.issueLink(r.Context(), g, ttl, singleUse)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, link)
+}
+
+//RevokeGuestLinks revokes the invitation links of a guest; its password still works
+func (hb *HandlerBridge) RevokeGuestLinks(w http.ResponseWriter, r *http.Request) {
+	g, err := hb.messageGuest(r)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	if err = hb.db.RevokeUserAuthKind(r.Context(), g.UserName, authKindLink); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, "Links revoked")
+}
+
+//ExchangeLink logs a guest in with its invitation link: the response is the
+//one of AuthorizeGuest. A single use link can't be used again
+func (hb *HandlerBridge) ExchangeLink(w http.ResponseWriter, r *http.Request) {
+	var la LinkAuth
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&la); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	// the signature is checked before reading the store
+	secret, err := getSecret()
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	token, err := parseJWT(la.Token, secret)
+	if err != nil {
+		hb.fail(w, r, unauthorized("Invalid link"))
+		return
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); !ok || claims["kind"] != authKindLink {
+		hb.fail(w, r, unauthorized("Invalid link"))
+		return
+	}
+	stored, err := hb.db.ReadAuth(r.Context(), la.Token)
+	if err != nil {
+		hb.fail(w, r, unauthorized("Invalid link"))
+		return
+	}
+	if err = checkAuthUsable(stored, authKindLink); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	g, err := hb.db.ReadGuest(r.Context(), stored.User)
+	if err == ErrNotFound {
+		err = unauthorized("The user of the link doesn't exist anymore")
+	}
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	// Revoke before issuing, like the refresh tokens
+	if stored.SingleUse {
+		if err = hb.revoke(r.Context(), stored); err != nil {
+			hb.fail(w, r, err)
+			return
+		}
+	}
+
+	usID := &UserIdentification{
+		UserName: g.UserName,
+		ID:       g.ID.Hex(),
+		Role:     roleOf(g),
+	}
+	if err = hb.issueTokens(r.Context(), usID); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.recordLogin(r, usID)
+
+	hb.rnd.JSON(w, http.StatusOK, usID)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//GetLockouts lists the user names and the addresses with failed logins,
+//the last failed first; the locked out ones have a locked_until
+func (hb *HandlerBridge) GetLockouts(w http.ResponseWriter, r *http.Request) {
+	hb.rnd.JSON(w, http.StatusOK, hb.guard.blocks(time.Now()))
+}
+
+//Unlock forgets the failed logins of a user name (/lockouts/user/{user_name})
+//or of an address (/lockouts/ip/{ip}), lifting its backoff and its lockout
+func (hb *HandlerBridge) Unlock(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kind := vars["kind"]
+	if kind != loginKeyUser && kind != loginKeyIP {
+		hb.fail(w, r, badRequest(errors.New("kind must be user or ip")))
+		return
+	}
+	if !hb.guard.unlock(kind, vars["key"]) {
+		hb.fail(w, r, ErrNotFound)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, "Unlocked")
+}
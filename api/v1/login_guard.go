@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of the keys of the login guard
+const (
+	loginKeyUser = "user"
+	loginKeyIP   = "ip"
+)
+
+// Protection of the logins: every password checked costs a bcrypt comparison
+const (
+	// the attempts past the free ones wait loginBaseDelay, doubled each time
+	loginBaseDelay = time.Second
+	loginMaxDelay  = 5 * time.Minute
+	// how long an address stays locked out
+	loginLockout = 15 * time.Minute
+	// failures older than that are forgotten
+	loginFailureWindow = time.Hour
+	// keys of a kind kept at most: the attempts can't grow the memory without end
+	loginMaxKeys = 10000
+)
+
+// loginLimit is the tolerance to the failures of a kind of key
+type loginLimit struct {
+	// failures before the backoff starts
+	free int
+	// failures locking the key out, never when 0
+	lockAfter int
+}
+
+// A family behind a box shares its address: it is allowed more failures than a user name.
+// A user name is only slowed down: anyone could lock a guest out otherwise
+var loginLimits = map[string]loginLimit{
+	loginKeyUser: {free: 3},
+	loginKeyIP:   {free: 10, lockAfter: 50},
+}
+
+//ErrLoginBlocked is returned to the logins refused before checking the password
+var ErrLoginBlocked = errors.New("Too many failed logins, retry later")
+
+//LoginBlock is the state of the failed logins of a user name or an address
+type LoginBlock struct {
+	// Kind is "user" or "ip"
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// RetryAt is when the next attempt is accepted
+	RetryAt time.Time `json:"retry_at"`
+	// LockedUntil is set while the key is locked out
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// loginFailures counts the failures of a key
+type loginFailures struct {
+	count       int
+	last        time.Time
+	retryAt     time.Time
+	lockedUntil time.Time
+}
+
+// wait returns how long the key has to wait before its next attempt
+func (f *loginFailures) wait(now time.Time) time.Duration {
+	if now.Before(f.lockedUntil) {
+		return f.lockedUntil.Sub(now)
+	}
+	if now.Before(f.retryAt) {
+		return f.retryAt.Sub(now)
+	}
+	return 0
+}
+
+// fail counts a failure and sets the backoff, or the lockout, of the next attempt
+func (f *loginFailures) fail(kind, key string, now time.Time) {
+	limit := loginLimits[kind]
+	// a lockout over, or failures out of the window, start a new series
+	if (!f.lockedUntil.IsZero() && !now.Before(f.lockedUntil)) || now.Sub(f.last) > loginFailureWindow {
+		*f = loginFailures{}
+	}
+	f.count++
+	f.last = now
+	if limit.lockAfter > 0 && f.count >= limit.lockAfter {
+		f.lockedUntil = now.Add(loginLockout)
+		log.Printf("Logins of %s %s locked out after %d failures", kind, key, f.count)
+		return
+	}
+	if f.count >= limit.free {
+		delay := loginBaseDelay << uint(f.count-limit.free)
+		if delay > loginMaxDelay || delay <= 0 {
+			delay = loginMaxDelay
+		}
+		f.retryAt = now.Add(delay)
+	}
+}
+
+//LoginGuard slows down the user names and the addresses failing to log in,
+//then locks the addresses out. Each attempt counts as a failure until its password is
+//checked: parallel attempts can't get past the backoff. The state is in memory
+type LoginGuard struct {
+	// trusted are the proxies whose X-Real-IP and X-Forwarded-For headers are read
+	trusted []*net.IPNet
+
+	mu        sync.Mutex
+	failures  map[string]map[string]*loginFailures
+	lastPrune time.Time
+}
+
+//Init set the proxies trusted to give the address of the clients
+func (lg *LoginGuard) Init(trusted []*net.IPNet) {
+	lg.trusted = trusted
+	lg.failures = map[string]map[string]*loginFailures{
+		loginKeyUser: {},
+		loginKeyIP:   {},
+	}
+}
+
+// parseTrustedProxies reads the addresses or networks separated by commas
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy %s", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %s", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// newLoginGuard reads the trusted proxies from EASYWED_TRUSTED_PROXIES
+func newLoginGuard() (*LoginGuard, error) {
+	trusted, err := parseTrustedProxies(os.Getenv("EASYWED_TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, err
+	}
+	lg := new(LoginGuard)
+	lg.Init(trusted)
+	return lg, nil
+}
+
+// trusts tells if ip is one of the trusted proxies
+func (lg *LoginGuard) trusts(ip net.IP) bool {
+	for _, n := range lg.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of r. The headers set by nginx
+// are only read when the request comes from a trusted proxy
+func (lg *LoginGuard) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !lg.trusts(peer) {
+		return host
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	// the rightmost address not of a proxy: the client can forge the ones on its left
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !lg.trusts(ip) {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// loginKeys returns the keys of an attempt. A request without address has no
+// ip key, a name that can't be a username has no user key
+func loginKeys(user, ip string) [][2]string {
+	keys := [][2]string{}
+	if sanitizeUserName(user) && len(user) <= maxUserNameLength {
+		keys = append(keys, [2]string{loginKeyUser, user})
+	}
+	if ip != "" {
+		keys = append(keys, [2]string{loginKeyIP, ip})
+	}
+	return keys
+}
+
+// attempt refuses the login of user from ip while one of them waits, and
+// counts it as a failure otherwise. The wait is returned when refused
+func (lg *LoginGuard) attempt(user, ip string, now time.Time) time.Duration {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	lg.prune(now)
+
+	keys := loginKeys(user, ip)
+	var wait time.Duration
+	for _, k := range keys {
+		if f := lg.failures[k[0]][k[1]]; f != nil {
+			if d := f.wait(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, k := range keys {
+		fs := lg.failures[k[0]]
+		f := fs[k[1]]
+		if f == nil {
+			if len(fs) >= loginMaxKeys {
+				evictLoginKey(fs, now)
+			}
+			f = new(loginFailures)
+			fs[k[1]] = f
+		}
+		f.fail(k[0], k[1], now)
+	}
+	return 0
+}
+
+// succeed forgets the failures of user. The address only gets back the
+// failure of its attempt: a known password doesn't clear the other guesses
+func (lg *LoginGuard) succeed(user, ip string) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	delete(lg.failures[loginKeyUser], user)
+	if f := lg.failures[loginKeyIP][ip]; f != nil && f.count > 0 {
+		f.count--
+		if f.count < loginLimits[loginKeyIP].free {
+			f.retryAt = time.Time{}
+		}
+	}
+}
+
+// prune forgets the keys without failures in the window, at most once per window
+func (lg *LoginGuard) prune(now time.Time) {
+	if now.Sub(lg.lastPrune) < loginFailureWindow {
+		return
+	}
+	lg.lastPrune = now
+	for _, fs := range lg.failures {
+		for key, f := range fs {
+			if now.Sub(f.last) > loginFailureWindow && !now.Before(f.lockedUntil) {
+				delete(fs, key)
+			}
+		}
+	}
+}
+
+// evictLoginKey makes room in the failures of a kind: the keys out of the
+// window go first, else the one failed the longest ago, locked out last
+func evictLoginKey(fs map[string]*loginFailures, now time.Time) {
+	oldest, found := "", false
+	for key, f := range fs {
+		locked := now.Before(f.lockedUntil)
+		if now.Sub(f.last) > loginFailureWindow && !locked {
+			delete(fs, key)
+			continue
+		}
+		if !found {
+			oldest, found = key, true
+			continue
+		}
+		o := fs[oldest]
+		if oldLocked := now.Before(o.lockedUntil); locked != oldLocked {
+			if oldLocked {
+				oldest = key
+			}
+		} else if f.last.Before(o.last) {
+			oldest = key
+		}
+	}
+	if len(fs) >= loginMaxKeys && found {
+		delete(fs, oldest)
+	}
+}
+
+// blocks lists the keys with failures, the last failed first
+func (lg *LoginGuard) blocks(now time.Time) []LoginBlock {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	lg.prune(now)
+
+	bs := []LoginBlock{}
+	for kind, fs := range lg.failures {
+		for key, f := range fs {
+			if f.count == 0 {
+				continue
+			}
+			b := LoginBlock{Kind: kind, Key: key, Failures: f.count, LastFailure: f.last, RetryAt: f.retryAt}
+			if now.Before(f.lockedUntil) {
+				until := f.lockedUntil
+				b.LockedUntil = &until
+				b.RetryAt = until
+			}
+			bs = append(bs, b)
+		}
+	}
+	sort.Slice(bs, func(i, j int) bool {
+		if !bs[i].LastFailure.Equal(bs[j].LastFailure) {
+			return bs[i].LastFailure.After(bs[j].LastFailure)
+		}
+		// the user names before the addresses
+		if bs[i].Kind != bs[j].Kind {
+			return bs[i].Kind == loginKeyUser
+		}
+		return bs[i].Key < bs[j].Key
+	})
+	return bs
+}
+
+// unlock forgets the failures of a key, false when it has none
+func (lg *LoginGuard) unlock(kind, key string) bool {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if _, ok := lg.failures[kind][key]; !ok {
+		return false
+	}
+	delete(lg.failures[kind], key)
+	return true
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -9,13 +10,21 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	mgo "gopkg.in/mgo.v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
-var db DataBridge
+const (
+	defaultSQLitePath = "easywed.db"
+	// size of the pool shared by all the requests
+	mongoMaxPoolSize = 50
+)
+
+var db Store
 var hb HandlerBridge
 var r *mux.Router
-var session *mgo.Session
+var client *mongo.Client
 
 func logErr(err error) {
 	if err != nil {
@@ -35,14 +44,21 @@ func connectToDb() error {
 		log.Fatal("No Db pwd provided")
 	}
 
-	dbInfo := mgo.DialInfo{
-		Username: user,
-		Password: pwd,
-		Addrs:    []string{"db-api"}, // docker-compose network
+	opts := options.Client().
+		SetHosts([]string{"db-api"}). // docker-compose network
+		SetAuth(options.Credential{Username: user, Password: pwd}).
+		SetMaxPoolSize(mongoMaxPoolSize)
+
+	client, err = mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return err
 	}
 
+	// Connect does not wait for the server: ping it before going on
 	for i := 0; i < 5; i++ {
-		session, err = mgo.DialWithInfo(&dbInfo)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = client.Ping(ctx, readpref.Primary())
+		cancel()
 		if err == nil {
 			return nil
 		}
@@ -50,22 +66,93 @@ func connectToDb() error {
 	return err
 }
 
-func init() {
-	err := connectToDb()
-	logErr(err)
+// newStore select the storage backend through the DB_TYPE variable:
+// "mongo" (the default), "sqlite" (file set by DB_PATH) or "memory" for demo instances
+func newStore() (Store, error) {
+	switch dbType := os.Getenv("DB_TYPE"); dbType {
+	case "", "mongo":
+		if err := connectToDb(); err != nil {
+			return nil, err
+		}
+		d := new(DataBridge)
+		if err := d.Init(client); err != nil {
+			return nil, err
+		}
+		// Give a role to the users and tokens stored with the auth codes
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := d.migrateRoles(ctx); err != nil {
+			return nil, err
+		}
+		// Split the invitees of the guests stored before the members
+		if err := d.migrateMembers(ctx); err != nil {
+			return nil, err
+		}
+		return d, nil
+	case "sqlite":
+		path := os.Getenv("DB_PATH")
+		if path == "" {
+			path = defaultSQLitePath
+		}
+		sb := new(SQLiteBridge)
+		if err := sb.Init(path); err != nil {
+			return nil, err
+		}
+		return sb, nil
+	case "memory":
+		log.Println("Using the in-memory store: data will be lost on exit")
+		mb := new(MemoryBridge)
+		mb.Init()
+		return mb, nil
+	default:
+		return nil, fmt.Errorf("Unknown DB_TYPE %s", dbType)
+	}
+}
 
-	db.Init(session)
+// initAPI wires the store to the handlers and build the router
+func initAPI(s Store) error {
+	db = s
 	hb.Init(db)
+	// refuse a malformed deadline now rather than on the first RSVP
+	if _, err := getRSVPDeadline(); err != nil {
+		return err
+	}
+	mailer, err := newMailer()
+	if err != nil {
+		return err
+	}
+	hb.outbox = nil
+	if mailer != nil {
+		hb.outbox = new(Outbox)
+		hb.outbox.Init(mailer)
+	}
+	if hb.notifier, err = newNotifier(hb.outbox); err != nil {
+		return err
+	}
+	if hb.guard, err = newLoginGuard(); err != nil {
+		return err
+	}
 	// check if admin is set, if not set it
-	if err = secureAdmin(); err != nil {
-		log.Fatal(err)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := secureAdmin(ctx); err != nil {
+		return err
 	}
 	r = NewRouter()
+	return nil
 }
 
 func main() {
-
-	defer session.Close()
+	s, err := newStore()
+	logErr(err)
+	logErr(initAPI(s))
+	// the reminders are only sent with an SMTP relay
+	var scheduler *ReminderScheduler
+	if hb.outbox != nil {
+		scheduler = new(ReminderScheduler)
+		scheduler.Init(db, hb.outbox, reminderInterval)
+		scheduler.Start()
+	}
 	var wait time.Duration
 	wait = 13 // to be fixed later
 
@@ -102,6 +189,18 @@ func main() {
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
 	srv.Shutdown(ctx)
+	scheduler.Close()
+	// Send the digest still waiting for its window
+	hb.notifier.Close()
+	hb.outbox.Close()
+	// Nothing uses the store anymore
+	if err := db.Close(); err != nil {
+		log.Println(err)
+	}
+	// Release the connection pool
+	if client != nil {
+		client.Disconnect(ctx)
+	}
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
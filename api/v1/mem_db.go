@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//MemoryBridge is an in-memory Store, safe for concurrent use.
+//Nothing survives a restart: use it for tests and demo instances
+type MemoryBridge struct {
+	mu      sync.RWMutex
+	guests  map[primitive.ObjectID]Guest
+	auths   map[string]Auth
+	events  map[primitive.ObjectID]Event
+	changes map[primitive.ObjectID]ChangeRequest
+	history []HistoryEntry
+	// reminders are the campaigns, sends the reminders sent by campaign
+	reminders map[primitive.ObjectID]Reminder
+	sends     map[primitive.ObjectID][]ReminderSend
+}
+
+//Init prepares the empty collections
+func (mb *MemoryBridge) Init() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.guests = make(map[primitive.ObjectID]Guest)
+	mb.auths = make(map[string]Auth)
+	mb.events = make(map[primitive.ObjectID]Event)
+	mb.changes = make(map[primitive.ObjectID]ChangeRequest)
+	mb.history = nil
+	mb.reminders = make(map[primitive.ObjectID]Reminder)
+	mb.sends = make(map[primitive.ObjectID][]ReminderSend)
+}
+
+//Close does nothing: the data goes with the process
+func (mb *MemoryBridge) Close() error {
+	return nil
+}
+
+// clone copies the members and the invitations as well: the callers change
+// them in place. The events attached to the invitations are not stored
+func (g Guest) clone() Guest {
+	if g.Members != nil {
+		g.Members = append([]Member{}, g.Members...)
+	}
+	if g.Events != nil {
+		invs := make([]Invitation, len(g.Events))
+		for i, inv := range g.Events {
+			inv.Attendees = append([]string{}, inv.Attendees...)
+			inv.Event = nil
+			invs[i] = inv
+		}
+		g.Events = invs
+	}
+	return g
+}
+
+//CreateGuest store the provided Guest in memory
+func (mb *MemoryBridge) CreateGuest(ctx context.Context, g *Guest) error {
+	if err := prepareGuest(g); err != nil {
+		return err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.userNameTaken(g.UserName, g.ID) {
+		return ErrUserNameTaken
+	}
+	mb.guests[g.ID] = g.clone()
+	return nil
+}
+
+// userNameTaken tells if a guest other than id, not deleted, has the
+// username, like the unique index of the other stores. mu must be held
+func (mb *MemoryBridge) userNameTaken(userName string, id primitive.ObjectID) bool {
+	for _, g := range mb.guests {
+		if g.UserName == userName && g.DeletedAt == nil && g.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+//ReadGuest fetch a guest by username
+func (mb *MemoryBridge) ReadGuest(ctx context.Context, userName string) (Guest, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	for _, g := range mb.guests {
+		if g.UserName == userName && g.DeletedAt == nil {
+			return g.clone(), nil
+		}
+	}
+	return Guest{}, ErrNotFound
+}
+
+//ReadGuestByID fetch a guest by id, even if deleted
+func (mb *MemoryBridge) ReadGuestByID(ctx context.Context, id primitive.ObjectID) (Guest, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	g, ok := mb.guests[id]
+	if !ok {
+		return Guest{}, ErrNotFound
+	}
+	return g.clone(), nil
+}
+
+// selectGuests returns the guests matching keep, ordered by creation
+func (mb *MemoryBridge) selectGuests(keep func(g Guest) bool) []Guest {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	gs := make([]Guest, 0, len(mb.guests))
+	for _, g := range mb.guests {
+		if keep(g) {
+			gs = append(gs, g.clone())
+		}
+	}
+	// ObjectIds start with a timestamp: the hex form sorts by creation
+	sort.Slice(gs, func(i, j int) bool { return gs[i].ID.Hex() < gs[j].ID.Hex() })
+	return gs
+}
+
+//ReadAll fetch all guests, ordered by creation
+func (mb *MemoryBridge) ReadAll(ctx context.Context) ([]Guest, error) {
+	return mb.selectGuests(func(g Guest) bool { return g.DeletedAt == nil }), nil
+}
+
+//QueryGuests filters, sorts and pages the guests
+func (mb *MemoryBridge) QueryGuests(ctx context.Context, q GuestQuery) ([]Guest, int, error) {
+	gs := mb.selectGuests(func(g Guest) bool { return g.DeletedAt == nil && q.matches(g) })
+	sort.Slice(gs, func(i, j int) bool { return q.less(gs[i], gs[j]) })
+	return q.page(gs), len(gs), nil
+}
+
+//ReadDeleted fetch the soft deleted guests
+func (mb *MemoryBridge) ReadDeleted(ctx context.Context) ([]Guest, error) {
+	return mb.selectGuests(func(g Guest) bool { return g.DeletedAt != nil }), nil
+}
+
+//UpdateGuest allows to modify certains attributes of a Guest
+func (mb *MemoryBridge) UpdateGuest(ctx context.Context, g *Guest) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stored, ok := mb.guests[g.ID]
+	if !ok || stored.DeletedAt != nil {
+		return ErrNotFound
+	}
+	// Same preselected attributes as the mongo implementation
+	stored.Modification = g.Modification
+	stored.Confirmed = g.Confirmed
+	stored.NeedsAccomodation = g.NeedsAccomodation
+	stored.NeedsPassage = g.NeedsPassage
+	stored.FoodRequirements = g.FoodRequirements
+	stored.RespondedAt = g.RespondedAt
+	stored.Members = g.Members
+	stored.Events = g.Events
+	mb.guests[g.ID] = stored.clone()
+	return nil
+}
+
+//EditGuest replaces every profile field of a guest, password included
+func (mb *MemoryBridge) EditGuest(ctx context.Context, g *Guest) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stored, ok := mb.guests[g.ID]
+	if !ok || stored.DeletedAt != nil {
+		return ErrNotFound
+	}
+	if mb.userNameTaken(g.UserName, g.ID) {
+		return ErrUserNameTaken
+	}
+	edited := g.clone()
+	edited.DeletedAt = nil
+	mb.guests[g.ID] = edited
+	return nil
+}
+
+//RecordLogin set the time of the last login of a guest
+func (mb *MemoryBridge) RecordLogin(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stored, ok := mb.guests[id]
+	if !ok || stored.DeletedAt != nil {
+		return ErrNotFound
+	}
+	stored.LastLoginAt = &at
+	mb.guests[id] = stored
+	return nil
+}
+
+//DeleteGuest soft deletes a guest: it is kept with the deletion date
+func (mb *MemoryBridge) DeleteGuest(ctx context.Context, id primitive.ObjectID) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stored, ok := mb.guests[id]
+	if !ok || stored.DeletedAt != nil {
+		return ErrNotFound
+	}
+	now := time.Now()
+	stored.DeletedAt = &now
+	mb.guests[id] = stored
+	return nil
+}
+
+//RestoreGuest cancels the soft deletion of a guest
+func (mb *MemoryBridge) RestoreGuest(ctx context.Context, id primitive.ObjectID) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stored, ok := mb.guests[id]
+	if !ok || stored.DeletedAt == nil {
+		return ErrNotFound
+	}
+	if mb.userNameTaken(stored.UserName, id) {
+		return ErrUserNameTaken
+	}
+	stored.DeletedAt = nil
+	mb.guests[id] = stored
+	return nil
+}
+
+//PurgeGuest removes for good a soft deleted guest
+func (mb *MemoryBridge) PurgeGuest(ctx context.Context, id primitive.ObjectID) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stored, ok := mb.guests[id]
+	if !ok || stored.DeletedAt == nil {
+		return ErrNotFound
+	}
+	delete(mb.guests, id)
+	return nil
+}
+
+//AuthGuest check the guest against the password
+func (mb *MemoryBridge) AuthGuest(ctx context.Context, username, password string) (*UserIdentification, error) {
+	return authGuest(ctx, mb, username, password)
+}
+
+//InsertAuth insert an auth object in memory
+func (mb *MemoryBridge) InsertAuth(ctx context.Context, a Auth) error {
+	if err := validateAuth(&a); err != nil {
+		return err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	//check if it exists already
+	if _, ok := mb.auths[a.Token]; ok {
+		return nil
+	}
+	mb.auths[a.Token] = a
+	return nil
+}
+
+//ReadAuth : read a token and return the Auth
+func (mb *MemoryBridge) ReadAuth(ctx context.Context, token string) (Auth, error) {
+	if token == "" {
+		return Auth{}, errors.New("No token provided")
+	}
+
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	a, ok := mb.auths[token]
+	if !ok {
+		return Auth{}, ErrNotFound
+	}
+	return a, nil
+}
+
+//UpdateAuth allow a selected update of an auth
+func (mb *MemoryBridge) UpdateAuth(ctx context.Context, auth *Auth) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stored, ok := mb.auths[auth.Token]
+	if !ok {
+		return ErrNotFound
+	}
+	//Check that we are not changing something letal
+	if err := checkAuthUpdate(stored, auth); err != nil {
+		return err
+	}
+	if !stored.Valid && !auth.Valid {
+		return ErrTokenRevoked
+	}
+	stored.Valid = auth.Valid
+	stored.Role = auth.Role
+	mb.auths[auth.Token] = stored
+	return nil
+}
+
+//RevokeUserAuths revokes every token of a user
+func (mb *MemoryBridge) RevokeUserAuths(ctx context.Context, user string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for token, a := range mb.auths {
+		if a.User == user {
+			a.Valid = false
+			mb.auths[token] = a
+		}
+	}
+	return nil
+}
+
+//RevokeUserAuthKind revokes the tokens of a kind of a user
+func (mb *MemoryBridge) RevokeUserAuthKind(ctx context.Context, user, kind string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for token, a := range mb.auths {
+		if a.User == user && a.Kind == kind {
+			a.Valid = false
+			mb.auths[token] = a
+		}
+	}
+	return nil
+}
+
+//CreateEvent store a new event
+func (mb *MemoryBridge) CreateEvent(ctx context.Context, e *Event) error {
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	e.ID = primitive.NewObjectID()
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.events[e.ID] = *e
+	return nil
+}
+
+//ReadEvent fetch an event by id
+func (mb *MemoryBridge) ReadEvent(ctx context.Context, id primitive.ObjectID) (Event, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	e, ok := mb.events[id]
+	if !ok {
+		return Event{}, ErrNotFound
+	}
+	return e, nil
+}
+
+//ReadEvents fetch every event, by starting time
+func (mb *MemoryBridge) ReadEvents(ctx context.Context) ([]Event, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	es := make([]Event, 0, len(mb.events))
+	for _, e := range mb.events {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].StartsAt.Before(es[j].StartsAt) })
+	return es, nil
+}
+
+//UpdateEvent replaces the fields of an event
+func (mb *MemoryBridge) UpdateEvent(ctx context.Context, e *Event) error {
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if _, ok := mb.events[e.ID]; !ok {
+		return ErrNotFound
+	}
+	mb.events[e.ID] = *e
+	return nil
+}
+
+//DeleteEvent removes an event and the invitations to it
+func (mb *MemoryBridge) DeleteEvent(ctx context.Context, id primitive.ObjectID) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if _, ok := mb.events[id]; !ok {
+		return ErrNotFound
+	}
+	delete(mb.events, id)
+	for gid, g := range mb.guests {
+		if i := g.invitation(id); i >= 0 {
+			g.Events = append(g.Events[:i:i], g.Events[i+1:]...)
+			mb.guests[gid] = g
+		}
+	}
+	return nil
+}
+
+// clone copies the members of the answer: the callers change them in place
+func (c ChangeRequest) clone() ChangeRequest {
+	c.RSVP.Members = append([]Member{}, c.RSVP.Members...)
+	return c
+}
+
+//CreateChange store a new pending change request
+func (mb *MemoryBridge) CreateChange(ctx context.Context, c *ChangeRequest) error {
+	prepareChange(c)
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.changes[c.ID] = c.clone()
+	return nil
+}
+
+//ReadChange fetch a change request by id
+func (mb *MemoryBridge) ReadChange(ctx context.Context, id primitive.ObjectID) (ChangeRequest, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	c, ok := mb.changes[id]
+	if !ok {
+		return ChangeRequest{}, ErrNotFound
+	}
+	return c.clone(), nil
+}
+
+//ReadChanges fetch the change requests with the status, every one when empty
+func (mb *MemoryBridge) ReadChanges(ctx context.Context, status string) ([]ChangeRequest, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	cs := []ChangeRequest{}
+	for _, c := range mb.changes {
+		if status == "" || c.Status == status {
+			cs = append(cs, c.clone())
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].CreatedAt.Before(cs[j].CreatedAt) })
+	return cs, nil
+}
+
+//DecideChange records the decision on a pending change request
+func (mb *MemoryBridge) DecideChange(ctx context.Context, c *ChangeRequest) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stored, ok := mb.changes[c.ID]
+	if !ok || stored.Status != changePending {
+		return ErrChangeDecided
+	}
+	stored.Status = c.Status
+	stored.DecidedAt = c.DecidedAt
+	stored.DecidedBy = c.DecidedBy
+	stored.Comment = c.Comment
+	mb.changes[c.ID] = stored
+	return nil
+}
+
+//ReopenChange puts back to pending a request decided with status
+func (mb *MemoryBridge) ReopenChange(ctx context.Context, id primitive.ObjectID, status string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	stored, ok := mb.changes[id]
+	if !ok || stored.Status != status {
+		return ErrNotFound
+	}
+	stored.Status = changePending
+	stored.DecidedAt = nil
+	stored.DecidedBy = ""
+	stored.Comment = ""
+	mb.changes[id] = stored
+	return nil
+}
+
+//AppendHistory store a new history entry
+func (mb *MemoryBridge) AppendHistory(ctx context.Context, h *HistoryEntry) error {
+	prepareHistory(h)
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	stored := *h
+	stored.Changes = append([]FieldChange{}, h.Changes...)
+	mb.history = append(mb.history, stored)
+	return nil
+}
+
+//ReadHistory fetch a page of the history and how many entries match the filters
+func (mb *MemoryBridge) ReadHistory(ctx context.Context, q HistoryQuery) ([]HistoryEntry, int, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	// the entries are appended in time order
+	hs := []HistoryEntry{}
+	for _, h := range mb.history {
+		if q.matches(h) {
+			h.Changes = append([]FieldChange{}, h.Changes...)
+			hs = append(hs, h)
+		}
+	}
+	return q.page(hs), len(hs), nil
+}
+
+//CreateReminder store a new campaign
+func (mb *MemoryBridge) CreateReminder(ctx context.Context, rm *Reminder) error {
+	prepareReminder(rm)
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.reminders[rm.ID] = *rm
+	return nil
+}
+
+//ReadReminder fetch a campaign by id
+func (mb *MemoryBridge) ReadReminder(ctx context.Context, id primitive.ObjectID) (Reminder, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	rm, ok := mb.reminders[id]
+	if !ok {
+		return Reminder{}, ErrNotFound
+	}
+	return rm, nil
+}
+
+//ReadReminders fetch the campaigns by sending date
+func (mb *MemoryBridge) ReadReminders(ctx context.Context) ([]Reminder, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	rms := []Reminder{}
+	for _, rm := range mb.reminders {
+		rms = append(rms, rm)
+	}
+	sort.Slice(rms, func(i, j int) bool { return rms[i].SendAt.Before(rms[j].SendAt) })
+	return rms, nil
+}
+
+//DeleteReminder removes a campaign not sent yet
+func (mb *MemoryBridge) DeleteReminder(ctx context.Context, id primitive.ObjectID) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	rm, ok := mb.reminders[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if rm.DoneAt != nil {
+		return ErrReminderDone
+	}
+	delete(mb.reminders, id)
+	return nil
+}
+
+//CompleteReminder marks a campaign as sent
+func (mb *MemoryBridge) CompleteReminder(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	rm, ok := mb.reminders[id]
+	if !ok {
+		return ErrNotFound
+	}
+	rm.DoneAt = &at
+	mb.reminders[id] = rm
+	return nil
+}
+
+//RecordReminderSend store the send of a reminder, once per campaign and guest
+func (mb *MemoryBridge) RecordReminderSend(ctx context.Context, s *ReminderSend) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for _, sent := range mb.sends[s.ReminderID] {
+		if sent.GuestID == s.GuestID {
+			return ErrReminderSent
+		}
+	}
+	mb.sends[s.ReminderID] = append(mb.sends[s.ReminderID], *s)
+	return nil
+}
+
+//ReadReminderSends fetch the sends of a campaign, by time
+func (mb *MemoryBridge) ReadReminderSends(ctx context.Context, reminderID primitive.ObjectID) ([]ReminderSend, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	// the sends are appended in time order
+	return append([]ReminderSend{}, mb.sends[reminderID]...), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+//Member is a person of the household invited by a Guest
+type Member struct {
+	Name             string `json:"name" bson:"name"`
+	Child            bool   `json:"child" bson:"child"`
+	Attending        bool   `json:"attending" bson:"attending"`
+	FoodRequirements string `json:"food_requirements" bson:"food_requirements"`
+	// Companion is set on the plus-ones named by the guest
+	Companion bool `json:"companion" bson:"companion"`
+}
+
+// inviteesSeparator splits the free text invitees written before the members:
+// "Anna and Marco", "Anna, Marco & Lea", "Anna e Marco", "Anna et Marco"
+var inviteesSeparator = regexp.MustCompile(`(?i)\s*(?:[,;&+/]|\band\b|\bet\b|\be\b)\s*`)
+
+// membersFromInvitees builds the household of a free text invitees
+func membersFromInvitees(invitees string) []Member {
+	var ms []Member
+	for _, name := range inviteesSeparator.Split(invitees, -1) {
+		if name = strings.TrimSpace(name); name != "" {
+			ms = append(ms, Member{Name: name})
+		}
+	}
+	return ms
+}
+
+// validateMembers checks that every member has a name, unique in the household
+func validateMembers(ms []Member) error {
+	seen := make(map[string]bool)
+	for _, m := range ms {
+		name := strings.ToLower(strings.TrimSpace(m.Name))
+		if name == "" {
+			return fieldError("members", errors.New("Member without a name"))
+		}
+		if seen[name] {
+			return fieldError("members", errors.New("Member "+m.Name+" listed twice"))
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// findMember returns the index of the member called name, -1 if missing
+func findMember(ms []Member, name string) int {
+	for i, m := range ms {
+		if strings.EqualFold(strings.TrimSpace(m.Name), strings.TrimSpace(name)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// setAttending gives the same answer for the whole household
+func (g *Guest) setAttending(attending bool) {
+	for i := range g.Members {
+		g.Members[i].Attending = attending
+	}
+}
+
+// syncMembers fills the household of the guests created with the invitees only,
+// then confirms the invitation when at least one member comes
+func (g *Guest) syncMembers() {
+	if len(g.Members) == 0 {
+		g.Members = membersFromInvitees(g.Invitees)
+		g.setAttending(g.Confirmed)
+	}
+	if len(g.Members) == 0 {
+		g.Members = []Member{}
+		return
+	}
+	g.Confirmed = false
+	for _, m := range g.Members {
+		g.Confirmed = g.Confirmed || m.Attending
+	}
+}
+
+// isHousehold tells if name is one of the members invited by the admin
+func (g Guest) isHousehold(name string) bool {
+	i := findMember(g.Members, name)
+	return i >= 0 && !g.Members[i].Companion
+}
+
+// companions returns how many plus-ones are named
+func (g Guest) companions() int {
+	n := 0
+	for _, m := range g.Members {
+		if m.Companion {
+			n++
+		}
+	}
+	return n
+}
+
+// answerRSVP copies the answer of the guest. When rsvp lists members, the
+// household members answer for themselves and the other names replace
+// the companions; otherwise the answer is for the whole household.
+// The members must have been validated
+func (g *Guest) answerRSVP(rsvp Guest) {
+	g.Modification = rsvp.Modification
+	g.NeedsAccomodation = rsvp.NeedsAccomodation
+	g.NeedsPassage = rsvp.NeedsPassage
+	g.FoodRequirements = rsvp.FoodRequirements
+	g.Confirmed = rsvp.Confirmed
+
+	if len(rsvp.Members) == 0 {
+		g.setAttending(rsvp.Confirmed)
+		g.syncMembers()
+		return
+	}
+
+	ms := []Member{}
+	for _, m := range g.Members {
+		if m.Companion {
+			continue
+		}
+		if i := findMember(rsvp.Members, m.Name); i >= 0 {
+			m.Attending = rsvp.Members[i].Attending
+			m.FoodRequirements = rsvp.Members[i].FoodRequirements
+		}
+		ms = append(ms, m)
+	}
+	for _, answer := range rsvp.Members {
+		if !g.isHousehold(answer.Name) {
+			answer.Name = strings.TrimSpace(answer.Name)
+			answer.Companion = true
+			ms = append(ms, answer)
+		}
+	}
+	g.Members = ms
+	g.syncMembers()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Kinds of the messages sent to the guests
+const (
+	messageInvitation   = "invitation"
+	messageConfirmation = "confirmation"
+	messageReminder     = "reminder"
+)
+
+// messageKinds are the kinds a template exists for, in every language
+var messageKinds = []string{messageInvitation, messageConfirmation, messageReminder}
+
+// defaultLanguage is the one of the guests without a translated template
+const defaultLanguage = "en"
+
+//ErrUnknownMessage is returned for a kind of message without templates
+var ErrUnknownMessage = errors.New("Unknown message")
+
+//ErrNoEmail is returned when sending a message to a guest without email
+var ErrNoEmail = errors.New("Guest has no email")
+
+// Each template defines a "subject" and a "body"
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+// languageNames maps the codes and the names stored in Guest.Language
+// to the languages with templates
+var languageNames = map[string]string{
+	"en": "en", "english": "en", "anglais": "en", "inglese": "en",
+	"fr": "fr", "french": "fr", "français": "fr", "francais": "fr", "francese": "fr",
+	"it": "it", "italian": "it", "italien": "it", "italiano": "it",
+}
+
+// the pages of the site, by language
+var sitePages = map[string]string{
+	"en": "index.html",
+	"fr": "index.fr.htm",
+	"it": "index.it.htm",
+}
+
+// months are the names of the months, by language
+var months = map[string][12]string{
+	"en": {"January", "February", "March", "April", "May", "June",
+		"July", "August", "September", "October", "November", "December"},
+	"fr": {"janvier", "février", "mars", "avril", "mai", "juin",
+		"juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+	"it": {"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno",
+		"luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+}
+
+// messageTemplates are the parsed templates by kind and language, "invitation.fr"
+var messageTemplates = parseMessageTemplates()
+
+func parseMessageTemplates() map[string]*template.Template {
+	ts := make(map[string]*template.Template)
+	for _, kind := range messageKinds {
+		for lang := range sitePages {
+			name := kind + "." + lang
+			funcs := template.FuncMap{
+				"date": func(t time.Time) string { return formatDate(t, lang) },
+				"join": strings.Join,
+			}
+			ts[name] = template.Must(template.New(name).Funcs(funcs).ParseFS(templateFS, "templates/"+name+".tmpl"))
+		}
+	}
+	return ts
+}
+
+// messageLanguage returns the language of the templates for g: "fr", "FR",
+// "fr-CH" and "Français" are all french. Unknown languages fall back to english
+func messageLanguage(g Guest) string {
+	lang := strings.ToLower(strings.TrimSpace(g.Language))
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		lang = lang[:i]
+	}
+	if l, ok := languageNames[lang]; ok {
+		return l
+	}
+	return defaultLanguage
+}
+
+// sitePage returns the page of the site in the language, empty without EASYWED_SITE_URL
+func sitePage(lang string) string {
+	site := os.Getenv("EASYWED_SITE_URL")
+	if site == "" {
+		return ""
+	}
+	return strings.TrimSuffix(site, "/") + "/" + sitePages[lang]
+}
+
+// formatDate writes the day of t in the language: "12 September 2026"
+func formatDate(t time.Time, lang string) string {
+	return fmt.Sprintf("%d %s %d", t.Day(), months[lang][t.Month()-1], t.Year())
+}
+
+// credentials are how the invitation logs the guest in: a new password or a link
+type credentials struct {
+	Password string
+	Link     string
+}
+
+// messageData is what the templates are rendered with
+type messageData struct {
+	Guest Guest
+	// Names greet the household: the invitees or the username
+	Names string
+	// Password and Link are only set on the invitations, one of them
+	Password string
+	Link     string
+	// LoginURL is the page of the site in the language, empty without EASYWED_SITE_URL
+	LoginURL string
+	Deadline *time.Time
+	// Attending are the members coming to the wedding
+	Attending []string
+	// Events are the invitations of the guest, with their events, by starting time
+	Events []Invitation
+}
+
+// newMessageData collects what the templates show of g
+func newMessageData(g Guest, lang string, c credentials) (messageData, error) {
+	d := messageData{Guest: g, Names: g.Invitees, Password: c.Password, Link: c.Link}
+	// sorted apart, the invitations of g keep their order
+	d.Events = append([]Invitation{}, g.Events...)
+	if strings.TrimSpace(d.Names) == "" {
+		d.Names = g.UserName
+	}
+	d.LoginURL = sitePage(lang)
+	deadline, err := getRSVPDeadline()
+	if err != nil {
+		return d, err
+	}
+	d.Deadline = deadline
+	for _, m := range g.Members {
+		if m.Attending {
+			d.Attending = append(d.Attending, m.Name)
+		}
+	}
+	sort.SliceStable(d.Events, func(i, j int) bool {
+		return d.Events[i].Event != nil && d.Events[j].Event != nil &&
+			d.Events[i].Event.StartsAt.Before(d.Events[j].Event.StartsAt)
+	})
+	return d, nil
+}
+
+// renderMessage writes the message of the kind for g, in the language of the
+// guest. The events of the invitations are expected to be attached
+func renderMessage(kind string, g Guest, c credentials) (Message, error) {
+	lang := messageLanguage(g)
+	t, ok := messageTemplates[kind+"."+lang]
+	if !ok {
+		return Message{}, ErrUnknownMessage
+	}
+	d, err := newMessageData(g, lang, c)
+	if err != nil {
+		return Message{}, err
+	}
+
+	var subject, body bytes.Buffer
+	if err = t.ExecuteTemplate(&subject, "subject", d); err != nil {
+		return Message{}, err
+	}
+	if err = t.ExecuteTemplate(&body, "body", d); err != nil {
+		return Message{}, err
+	}
+	m := Message{Subject: strings.TrimSpace(subject.String()), Body: body.String()}
+	if g.Email != "" {
+		m.To = []string{g.Email}
+	}
+	return m, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// messageGuest reads the guest of the request, not deleted, with its events
+func (hb *HandlerBridge) messageGuest(r *http.Request) (Guest, error) {
+	id, err := guestIDFromVars(r)
+	if err != nil {
+		return Guest{}, err
+	}
+	g, err := hb.db.ReadGuestByID(r.Context(), id)
+	if err == nil && g.DeletedAt != nil {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return g, err
+	}
+	gs := []Guest{g}
+	err = hb.attachEvents(r, gs)
+	return gs[0], err
+}
+
+// checkOutbox refuses to send when no email can be sent
+func (hb *HandlerBridge) checkOutbox(g Guest) error {
+	if hb.outbox == nil {
+		return newAPIError(http.StatusServiceUnavailable, CodeNotConfigured, "Email is not configured")
+	}
+	if g.Email == "" {
+		return ErrNoEmail
+	}
+	return nil
+}
+
+//PreviewMessage renders the invitation, confirmation or reminder of a guest,
+//in its language, without sending it. The password of the invitation is hidden
+func (hb *HandlerBridge) PreviewMessage(w http.ResponseWriter, r *http.Request) {
+	g, err := hb.messageGuest(r)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	m, err := renderMessage(mux.Vars(r)["kind"], g, credentials{Password: historyHidden})
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, m)
+}
+
+//SendInvitation emails the invitation to a guest with its username, the
+//password being kept. A new password is generated, and the tokens of the old
+//one revoked, for a guest without password or with ?reset_password=true.
+//With ?link=true the invitation carries a new invitation link instead
+func (hb *HandlerBridge) SendInvitation(w http.ResponseWriter, r *http.Request) {
+	g, err := hb.messageGuest(r)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	if err = hb.checkOutbox(g); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	switch {
+	case r.URL.Query().Get("link") == "true":
+		hb.sendInvitationLink(w, r, g)
+		return
+	case r.URL.Query().Get("reset_password") == "true" || g.Password == "":
+		hb.sendInvitationPassword(w, r, g)
+		return
+	}
+
+	m, err := renderMessage(messageInvitation, g, credentials{})
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyInvitation, g, g)
+
+	hb.outbox.Send(m)
+	hb.rnd.JSON(w, http.StatusOK, "Invitation sent")
+}
+
+// sendInvitationPassword emails the invitation with a new password
+func (hb *HandlerBridge) sendInvitationPassword(w http.ResponseWriter, r *http.Request, g Guest) {
+	pwd, err := generatePassword()
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	// rendered before the password changes: a broken template changes nothing
+	m, err := renderMessage(messageInvitation, g, credentials{Password: pwd})
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	previous := g.clone()
+	if g.Password, err = hashPassword(pwd); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	if err = hb.db.EditGuest(r.Context(), &g); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyInvitation, previous, g)
+	if err = hb.db.RevokeUserAuths(r.Context(), g.UserName); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	hb.outbox.Send(m)
+	hb.rnd.JSON(w, http.StatusOK, "Invitation sent")
+}
+
+// sendInvitationLink emails the invitation with a new link to the site
+func (hb *HandlerBridge) sendInvitationLink(w http.ResponseWriter, r *http.Request, g Guest) {
+	if sitePage(messageLanguage(g)) == "" {
+		hb.fail(w, r, newAPIError(http.StatusServiceUnavailable, CodeNotConfigured, "EASYWED_SITE_URL is not configured"))
+		return
+	}
+	link, err := hb.issueLink(r.Context(), g, defaultLinkTTL, true)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	m, err := renderMessage(messageInvitation, g, credentials{Link: link.URL})
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.record(r, historyInvitation, g, g)
+
+	hb.outbox.Send(m)
+	hb.rnd.JSON(w, http.StatusOK, "Invitation sent")
+}
+
+//SendReminder emails a reminder to answer the RSVP to a guest
+func (hb *HandlerBridge) SendReminder(w http.ResponseWriter, r *http.Request) {
+	g, err := hb.messageGuest(r)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	if err = hb.checkOutbox(g); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	m, err := renderMessage(messageReminder, g, credentials{})
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.outbox.Send(m)
+	hb.rnd.JSON(w, http.StatusOK, "Reminder sent")
+}
+
+// sendConfirmation emails the receipt of the RSVP of g, when it has an email.
+// The RSVP is already stored: a failure is logged, it doesn't fail the request
+func (hb *HandlerBridge) sendConfirmation(r *http.Request, g Guest) {
+	if hb.outbox == nil || g.Email == "" {
+		return
+	}
+	gs := []Guest{g.clone()}
+	if err := hb.attachEvents(r, gs); err != nil {
+		log.Printf("Confirmation of %s not sent: %s", g.UserName, err)
+		return
+	}
+	m, err := renderMessage(messageConfirmation, gs[0], credentials{})
+	if err != nil {
+		log.Printf("Confirmation of %s not sent: %s", g.UserName, err)
+		return
+	}
+	hb.outbox.Send(m)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// changes arriving within the window are sent in a single digest
+	defaultNotifyWindow = 5 * time.Minute
+	// attempts after the first failed one
+	notifyRetries = 4
+)
+
+// notifyBackoff is the wait before the first retry, doubled at each one; lowered by the tests only
+var notifyBackoff = 30 * time.Second
+
+//Message is a plain text email
+type Message struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+}
+
+//Mailer sends a plain text email
+type Mailer interface {
+	Send(m Message) error
+}
+
+// smtpMailer sends through an SMTP relay; auth is nil for the relays without authentication
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+//Send builds the message and hands it to the relay
+func (sm smtpMailer) Send(m Message) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", sm.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return smtp.SendMail(sm.addr, sm.auth, sm.from, m.To, []byte(msg.String()))
+}
+
+// newMailer configures the SMTP relay from the environment: nil when
+// EASYWED_SMTP_ADDR is not set
+func newMailer() (Mailer, error) {
+	addr := os.Getenv("EASYWED_SMTP_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid EASYWED_SMTP_ADDR: %s", err)
+	}
+	from := os.Getenv("EASYWED_SMTP_FROM")
+	if from == "" {
+		return nil, errors.New("No EASYWED_SMTP_FROM set")
+	}
+
+	m := smtpMailer{addr: addr, from: from}
+	if user := os.Getenv("EASYWED_SMTP_USER"); user != "" {
+		m.auth = smtp.PlainAuth("", user, os.Getenv("EASYWED_SMTP_PWD"), host)
+	}
+	return m, nil
+}
+
+//Outbox sends the messages in the background, retrying with a growing
+//wait: a failing relay never slows down the requests. A nil Outbox sends nothing
+type Outbox struct {
+	mailer Mailer
+	wg     sync.WaitGroup
+	// closed by Close: the messages waiting for a retry are dropped
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+//Init set the mailer sending the messages
+func (o *Outbox) Init(mailer Mailer) {
+	o.mailer = mailer
+	o.done = make(chan struct{})
+}
+
+//Send queues the message and returns at once
+func (o *Outbox) Send(m Message) {
+	if o == nil {
+		return
+	}
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		o.deliver(m)
+	}()
+}
+
+// deliver sends the message, retrying on failures
+func (o *Outbox) deliver(m Message) error {
+	var err error
+	for attempt := 0; attempt <= notifyRetries; attempt++ {
+		if attempt > 0 && !o.wait(notifyBackoff<<(attempt-1)) {
+			log.Printf("Message %q to %s dropped at shutdown: %s", m.Subject, strings.Join(m.To, ", "), err)
+			return err
+		}
+		if err = o.mailer.Send(m); err == nil {
+			return nil
+		}
+		log.Printf("Sending %q attempt %d failed: %s", m.Subject, attempt+1, err)
+	}
+	log.Printf("Message %q to %s dropped: %s", m.Subject, strings.Join(m.To, ", "), err)
+	return err
+}
+
+// wait sleeps for d, false when the outbox is closed meanwhile
+func (o *Outbox) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-o.done:
+		return false
+	}
+}
+
+//Close waits for the messages being sent; the ones waiting for a retry are dropped
+func (o *Outbox) Close() {
+	if o == nil {
+		return
+	}
+	o.stop()
+	o.wg.Wait()
+}
+
+// stop drops the retries from now on, the messages still get their first attempt
+func (o *Outbox) stop() {
+	o.closeOnce.Do(func() {
+		if o.done != nil {
+			close(o.done)
+		}
+	})
+}
+
+//RSVPNotice is a change of RSVP to tell the couple about
+type RSVPNotice struct {
+	UserName string
+	Invitees string
+	At       time.Time
+	Changes  []FieldChange
+}
+
+// rsvpNotice describes the change of the RSVP of a guest
+func rsvpNotice(before, after Guest) RSVPNotice {
+	return RSVPNotice{
+		UserName: after.UserName,
+		Invitees: after.Invitees,
+		At:       time.Now(),
+		Changes:  guestDiff(before, after),
+	}
+}
+
+// digest writes the subject and the readable body of the notices
+func digest(notices []RSVPNotice) (string, string) {
+	subject := "[EasyWed] 1 RSVP change"
+	if len(notices) > 1 {
+		subject = fmt.Sprintf("[EasyWed] %d RSVP changes", len(notices))
+	}
+
+	var body strings.Builder
+	for i, n := range notices {
+		if i > 0 {
+			body.WriteString("\n")
+		}
+		fmt.Fprintf(&body, "%s (%s), %s\n", n.UserName, n.Invitees, n.At.Format("Mon 2 Jan 15:04"))
+		for _, c := range n.Changes {
+			fmt.Fprintf(&body, "  %s: %q -> %q\n", c.Field, c.Before, c.After)
+		}
+	}
+	return subject, body.String()
+}
+
+//Notifier emails the RSVP changes to the couple. The changes are batched
+//in a digest sent through the outbox when the window is over. A nil Notifier sends nothing
+type Notifier struct {
+	outbox *Outbox
+	to     []string
+	window time.Duration
+
+	mu      sync.Mutex
+	pending []RSVPNotice
+	timer   *time.Timer
+	wg      sync.WaitGroup
+}
+
+//Init set the outbox, the recipients and the window of the digests
+func (n *Notifier) Init(outbox *Outbox, to []string, window time.Duration) {
+	n.outbox = outbox
+	n.to = to
+	n.window = window
+}
+
+// newNotifier configures the notifications from the environment: nil
+// without outbox or when EASYWED_NOTIFY_TO is not set
+func newNotifier(outbox *Outbox) (*Notifier, error) {
+	var to []string
+	for _, a := range strings.Split(os.Getenv("EASYWED_NOTIFY_TO"), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			to = append(to, a)
+		}
+	}
+	if outbox == nil || len(to) == 0 {
+		return nil, nil
+	}
+	window := defaultNotifyWindow
+	if s := os.Getenv("EASYWED_NOTIFY_WINDOW"); s != "" {
+		var err error
+		if window, err = time.ParseDuration(s); err != nil || window < 0 {
+			return nil, fmt.Errorf("Invalid EASYWED_NOTIFY_WINDOW %q", s)
+		}
+	}
+
+	n := new(Notifier)
+	n.Init(outbox, to, window)
+	return n, nil
+}
+
+//Notify queues a change for the next digest; it never blocks on the mailer
+func (n *Notifier) Notify(notice RSVPNotice) {
+	if n == nil || len(notice.Changes) == 0 {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.pending = append(n.pending, notice)
+	if n.timer == nil {
+		n.wg.Add(1)
+		n.timer = time.AfterFunc(n.window, func() {
+			defer n.wg.Done()
+			n.flush()
+		})
+	}
+}
+
+// flush sends the digest of the pending notices
+func (n *Notifier) flush() {
+	n.mu.Lock()
+	notices := n.pending
+	n.pending = nil
+	n.timer = nil
+	n.mu.Unlock()
+	if len(notices) == 0 {
+		return
+	}
+
+	subject, body := digest(notices)
+	// the flush already runs in the background
+	n.outbox.deliver(Message{To: n.to, Subject: subject, Body: body})
+}
+
+//Close sends the digest still waiting for its window and waits for the sendings.
+//The outbox is stopped first: the digests failing are not retried
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	n.outbox.stop()
+	n.mu.Lock()
+	if n.timer != nil && n.timer.Stop() {
+		// the timer won't fire: its digest is sent now
+		n.mu.Unlock()
+		n.flush()
+		n.wg.Done()
+	} else {
+		n.mu.Unlock()
+	}
+	n.wg.Wait()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes every route of the router: main_test.go checks
+// that they stay in line
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+//GetOpenAPI serves the OpenAPI 3 document of the API
+func (hb *HandlerBridge) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// reminderInterval is how often the scheduler looks for the campaigns due
+const reminderInterval = time.Minute
+
+// Reasons a guest is reminded
+const (
+	// the RSVP is still pending
+	reminderNoAnswer = "no_answer"
+	// answered for the guest, who never logged in
+	reminderNeverLoggedIn = "never_logged_in"
+)
+
+// reminderReason returns why g is to remind, empty when it isn't
+func reminderReason(g Guest) string {
+	if roleOf(g) != RoleGuest {
+		return ""
+	}
+	if g.RespondedAt == nil {
+		return reminderNoAnswer
+	}
+	if g.LastLoginAt == nil {
+		return reminderNeverLoggedIn
+	}
+	return ""
+}
+
+// validateReminder checks the date of a campaign against the RSVP deadline
+func validateReminder(rm Reminder) error {
+	if rm.SendAt.IsZero() {
+		return errors.New("send_at is required")
+	}
+	deadline, err := getRSVPDeadline()
+	if err != nil {
+		return err
+	}
+	if deadline != nil && !rm.SendAt.Before(*deadline) {
+		return errors.New("Reminders are sent before the RSVP deadline")
+	}
+	return nil
+}
+
+//ReminderPreview is what a campaign would send if it ran now
+type ReminderPreview struct {
+	Reminder   Reminder       `json:"reminder"`
+	Recipients []ReminderSend `json:"recipients"`
+	// WithoutEmail are the user names of the guests to remind without an email
+	WithoutEmail []string `json:"without_email"`
+	messages     []Message
+}
+
+// planReminder selects the guests to remind, the ones already sent the
+// campaign excepted, and renders their reminder in their language
+func planReminder(ctx context.Context, s Store, rm Reminder) (ReminderPreview, error) {
+	p := ReminderPreview{Reminder: rm, Recipients: []ReminderSend{}, WithoutEmail: []string{}}
+	gs, err := s.ReadAll(ctx)
+	if err != nil {
+		return p, err
+	}
+	if err = attachEvents(ctx, s, gs); err != nil {
+		return p, err
+	}
+	ss, err := s.ReadReminderSends(ctx, rm.ID)
+	if err != nil {
+		return p, err
+	}
+	sent := make(map[primitive.ObjectID]bool, len(ss))
+	for _, sd := range ss {
+		sent[sd.GuestID] = true
+	}
+
+	for _, g := range gs {
+		reason := reminderReason(g)
+		if reason == "" || sent[g.ID] {
+			continue
+		}
+		if g.Email == "" {
+			p.WithoutEmail = append(p.WithoutEmail, g.UserName)
+			continue
+		}
+		m, err := renderMessage(messageReminder, g, credentials{})
+		if err != nil {
+			return p, err
+		}
+		p.Recipients = append(p.Recipients, ReminderSend{
+			ReminderID: rm.ID,
+			GuestID:    g.ID,
+			UserName:   g.UserName,
+			Email:      g.Email,
+			Language:   messageLanguage(g),
+			Reason:     reason,
+			Subject:    m.Subject,
+		})
+		p.messages = append(p.messages, m)
+	}
+	return p, nil
+}
+
+//ReminderScheduler sends the reminder campaigns when their date comes. Each
+//send is stored before its message is queued: after a restart the campaigns
+//left half done go on, without reminding a guest twice. A nil scheduler does nothing
+type ReminderScheduler struct {
+	db       Store
+	outbox   *Outbox
+	interval time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+//Init set the store, the outbox sending the reminders and how often to look for the campaigns due
+func (rs *ReminderScheduler) Init(db Store, outbox *Outbox, interval time.Duration) {
+	rs.db = db
+	rs.outbox = outbox
+	rs.interval = interval
+	rs.stop = make(chan struct{})
+}
+
+//Start runs the scheduler in the background, the campaigns past due first
+func (rs *ReminderScheduler) Start() {
+	if rs == nil {
+		return
+	}
+	rs.wg.Add(1)
+	go func() {
+		defer rs.wg.Done()
+		ticker := time.NewTicker(rs.interval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), rs.interval)
+			if err := rs.runDue(ctx, time.Now()); err != nil {
+				log.Printf("Reminders not sent: %s", err)
+			}
+			cancel()
+			select {
+			case <-rs.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+//Close stops the scheduler, waiting for the campaign being sent
+func (rs *ReminderScheduler) Close() {
+	if rs == nil {
+		return
+	}
+	close(rs.stop)
+	rs.wg.Wait()
+}
+
+// runDue sends the campaigns due at now and not done yet
+func (rs *ReminderScheduler) runDue(ctx context.Context, now time.Time) error {
+	deadline, err := getRSVPDeadline()
+	if err != nil {
+		return err
+	}
+	rms, err := rs.db.ReadReminders(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, rm := range rms {
+		if rm.DoneAt != nil || rm.SendAt.After(now) {
+			continue
+		}
+		// nothing left to answer: the campaign is closed unsent
+		if deadline != nil && now.After(*deadline) {
+			log.Printf("Reminder %s not sent: the RSVP deadline has passed", rm.ID.Hex())
+		} else if err = rs.send(ctx, rm, now); err != nil {
+			return err
+		}
+		if err = rs.db.CompleteReminder(ctx, rm.ID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send reminds every guest of the campaign not reminded yet
+func (rs *ReminderScheduler) send(ctx context.Context, rm Reminder, now time.Time) error {
+	p, err := planReminder(ctx, rs.db, rm)
+	if err != nil {
+		return err
+	}
+	for i, s := range p.Recipients {
+		s.SentAt = now
+		err = rs.db.RecordReminderSend(ctx, &s)
+		if err == ErrReminderSent {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rs.outbox.Send(p.messages[i])
+	}
+	log.Printf("Reminder %s sent to %d guests, %d without email", rm.ID.Hex(), len(p.Recipients), len(p.WithoutEmail))
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//ErrReminderDone is returned when changing a campaign already sent
+var ErrReminderDone = errors.New("Reminder already sent")
+
+//ErrReminderSent is returned when a guest already had the reminder of a campaign
+var ErrReminderSent = errors.New("Reminder already sent to the guest")
+
+//Reminder is a campaign of reminders, sent on the date chosen by the admin
+//to the guests still to remind
+type Reminder struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	SendAt    time.Time          `json:"send_at" bson:"send_at"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	CreatedBy string             `json:"created_by" bson:"created_by"`
+	// DoneAt is set once the scheduler went through every guest
+	DoneAt *time.Time `json:"done_at,omitempty" bson:"done_at,omitempty"`
+	// Sent is how many guests had the reminder, only filled in the responses
+	Sent int `json:"sent" bson:"-"`
+}
+
+//ReminderSend records the reminder of a campaign sent to a guest
+type ReminderSend struct {
+	ReminderID primitive.ObjectID `json:"reminder_id" bson:"reminder_id"`
+	GuestID    primitive.ObjectID `json:"guest_id" bson:"guest_id"`
+	UserName   string             `json:"user_name" bson:"user_name"`
+	Email      string             `json:"email" bson:"email"`
+	Language   string             `json:"language" bson:"language"`
+	// Reason is why the guest is reminded: no_answer or never_logged_in
+	Reason  string    `json:"reason" bson:"reason"`
+	Subject string    `json:"subject" bson:"subject"`
+	SentAt  time.Time `json:"sent_at" bson:"sent_at"`
+}
+
+// prepareReminder set a new id and the creation time of a campaign
+func prepareReminder(rm *Reminder) {
+	rm.ID = primitive.NewObjectID()
+	rm.CreatedAt = time.Now()
+	rm.DoneAt = nil
+}
+
+func (db *DataBridge) reminderColl() *mongo.Collection {
+	return db.client.Database(dbName).Collection(reminderCollection)
+}
+
+func (db *DataBridge) reminderSendColl() *mongo.Collection {
+	return db.client.Database(dbName).Collection(reminderSendCollection)
+}
+
+//CreateReminder store a new campaign
+func (db *DataBridge) CreateReminder(ctx context.Context, rm *Reminder) error {
+	prepareReminder(rm)
+	_, err := db.reminderColl().InsertOne(ctx, rm)
+	return err
+}
+
+//ReadReminder fetch a campaign by id
+func (db *DataBridge) ReadReminder(ctx context.Context, id primitive.ObjectID) (Reminder, error) {
+	var rm Reminder
+	err := db.reminderColl().FindOne(ctx, bson.M{"_id": id}).Decode(&rm)
+	return rm, mongoErr(err)
+}
+
+//ReadReminders fetch the campaigns by sending date
+func (db *DataBridge) ReadReminders(ctx context.Context) ([]Reminder, error) {
+	rms := []Reminder{}
+	opts := options.Find().SetSort(bson.D{{Key: "send_at", Value: 1}})
+	cur, err := db.reminderColl().Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return rms, err
+	}
+	err = cur.All(ctx, &rms)
+	return rms, err
+}
+
+//DeleteReminder removes a campaign not sent yet
+func (db *DataBridge) DeleteReminder(ctx context.Context, id primitive.ObjectID) error {
+	res, err := db.reminderColl().DeleteOne(ctx, bson.M{"_id": id, "done_at": nil})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		if _, err = db.ReadReminder(ctx, id); err == nil {
+			return ErrReminderDone
+		}
+		return err
+	}
+	return nil
+}
+
+//CompleteReminder marks a campaign as sent
+func (db *DataBridge) CompleteReminder(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	return updateErr(db.reminderColl().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"done_at": at}}))
+}
+
+//RecordReminderSend store the send of a reminder, once per campaign and guest
+func (db *DataBridge) RecordReminderSend(ctx context.Context, s *ReminderSend) error {
+	filter := bson.M{"reminder_id": s.ReminderID, "guest_id": s.GuestID}
+	res, err := db.reminderSendColl().UpdateOne(ctx, filter, bson.M{"$setOnInsert": s},
+		options.Update().SetUpsert(true))
+	// a concurrent upsert loses on the unique index
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrReminderSent
+	}
+	if err != nil {
+		return err
+	}
+	if res.UpsertedCount == 0 {
+		return ErrReminderSent
+	}
+	return nil
+}
+
+//ReadReminderSends fetch the sends of a campaign, by time
+func (db *DataBridge) ReadReminderSends(ctx context.Context, reminderID primitive.ObjectID) ([]ReminderSend, error) {
+	ss := []ReminderSend{}
+	opts := options.Find().SetSort(bson.D{{Key: "sent_at", Value: 1}})
+	cur, err := db.reminderSendColl().Find(ctx, bson.M{"reminder_id": reminderID}, opts)
+	if err != nil {
+		return ss, err
+	}
+	err = cur.All(ctx, &ss)
+	return ss, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+//GetReminders retrieve the campaigns by sending date, with how many guests had them
+func (hb *HandlerBridge) GetReminders(w http.ResponseWriter, r *http.Request) {
+	rms, err := hb.db.ReadReminders(r.Context())
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	for i := range rms {
+		ss, err := hb.db.ReadReminderSends(r.Context(), rms[i].ID)
+		if err != nil {
+			hb.fail(w, r, err)
+			return
+		}
+		rms[i].Sent = len(ss)
+	}
+	hb.rnd.JSON(w, http.StatusOK, rms)
+}
+
+//AddReminder schedules a campaign: on send_at the guests who didn't answer
+//or never logged in are sent a reminder in their language
+func (hb *HandlerBridge) AddReminder(w http.ResponseWriter, r *http.Request) {
+	var rm Reminder
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&rm); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	if err := validateReminder(rm); err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	if a, err := requestAuth(r, hb.db); err == nil {
+		rm.CreatedBy = a.User
+	}
+
+	if err := hb.db.CreateReminder(r.Context(), &rm); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, rm)
+}
+
+//RemoveReminder cancels a campaign not sent yet
+func (hb *HandlerBridge) RemoveReminder(w http.ResponseWriter, r *http.Request) {
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+
+	if err = hb.db.DeleteReminder(r.Context(), id); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, "Reminder deleted")
+}
+
+//PreviewReminder is the dry run of a campaign: the guests it would remind
+//if it ran now, with the subject in their language. Nothing is sent nor stored
+func (hb *HandlerBridge) PreviewReminder(w http.ResponseWriter, r *http.Request) {
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	rm, err := hb.db.ReadReminder(r.Context(), id)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	p, err := planReminder(r.Context(), hb.db, rm)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, p)
+}
+
+//GetReminderSends retrieve the reminders sent by a campaign
+func (hb *HandlerBridge) GetReminderSends(w http.ResponseWriter, r *http.Request) {
+	id, err := idFromVars(r, "id")
+	if err != nil {
+		hb.fail(w, r, badRequest(err))
+		return
+	}
+	if _, err = hb.db.ReadReminder(r.Context(), id); err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+
+	ss, err := hb.db.ReadReminderSends(r.Context(), id)
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, ss)
+}
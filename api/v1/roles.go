@@ -0,0 +1,113 @@
+package main
+
+//Permission is the right to call a family of APIs
+type Permission string
+
+// Named permissions, declared by each Route
+const (
+	// read its own invitation
+	PermReadGuest Permission = "guest.read"
+	// answer its own RSVP
+	PermUpdateGuest Permission = "guest.update"
+	// list every guest
+	PermReadAll Permission = "guests.read_all"
+	// invite a new guest
+	PermCreateGuest Permission = "guests.create"
+	// give a role other than guest to a user
+	PermManageRoles Permission = "roles.manage"
+	// soft delete and restore a guest
+	PermDeleteGuest Permission = "guests.delete"
+	// remove for good a deleted guest
+	PermPurgeGuest Permission = "guests.purge"
+	// change any profile field of a guest, password included
+	PermEditGuest Permission = "guests.edit"
+	// invite guests in bulk from a CSV file
+	PermImportGuests Permission = "guests.import"
+	// download the guest list as a spreadsheet
+	PermExportGuests Permission = "guests.export"
+	// read the RSVP numbers
+	PermReadStats Permission = "stats.read"
+	// list the events
+	PermReadEvents Permission = "events.read"
+	// create, change and delete the events
+	PermManageEvents Permission = "events.manage"
+	// answer its own invitations to the events
+	PermAnswerEvent Permission = "event.answer"
+	// ask a change of its own RSVP after the deadline
+	PermRequestChange Permission = "change.request"
+	// approve or reject the change requests
+	PermManageChanges Permission = "changes.manage"
+	// read the history of the changes of the guests
+	PermReadHistory Permission = "history.read"
+	// preview the emails of the guests, send the invitations and the reminders
+	PermSendMessages Permission = "messages.send"
+	// schedule the reminder campaigns and follow what they sent
+	PermManageReminders Permission = "reminders.manage"
+	// generate and revoke the invitation links of the guests
+	PermManageLinks Permission = "links.manage"
+	// follow the failed logins and lift the lockouts
+	PermManageLockouts Permission = "lockouts.manage"
+)
+
+//Role is stored on the user and copied on its tokens
+type Role string
+
+// The roles a user can have
+const (
+	RoleGuest   Role = "guest"
+	RoleViewer  Role = "viewer"
+	RolePlanner Role = "planner"
+	RoleAdmin   Role = "admin"
+)
+
+// rolePermissions is the single place where rights are granted
+var rolePermissions = map[Role][]Permission{
+	RoleGuest:  {PermReadGuest, PermUpdateGuest, PermAnswerEvent, PermRequestChange},
+	RoleViewer: {PermReadGuest, PermReadAll, PermReadEvents},
+	RolePlanner: {PermReadGuest, PermReadAll, PermCreateGuest, PermImportGuests,
+		PermReadEvents, PermManageEvents},
+	RoleAdmin: {PermReadGuest, PermUpdateGuest, PermReadAll, PermCreateGuest, PermManageRoles,
+		PermDeleteGuest, PermPurgeGuest, PermEditGuest, PermImportGuests, PermExportGuests, PermReadStats,
+		PermReadEvents, PermManageEvents, PermAnswerEvent, PermRequestChange, PermManageChanges,
+		PermReadHistory, PermSendMessages, PermManageReminders, PermManageLinks,
+		PermManageLockouts},
+}
+
+func validRole(role Role) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// roleHasPermission check the permission against the rights of the role
+func roleHasPermission(role Role, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// roleOf returns the role of a guest: users stored before the roles are guests
+func roleOf(g Guest) Role {
+	if g.Role == "" {
+		return RoleGuest
+	}
+	return g.Role
+}
+
+// Prime codes used by the tokens issued before the roles: kept only to migrate them
+const (
+	legacyAPICreateGuest = 5
+	legacyAPIReadAll     = 7
+	// only the admin had both the create and the read all rights
+	legacyAdminDivisor = legacyAPICreateGuest * legacyAPIReadAll
+)
+
+// roleFromAuthCode converts the prime auth code of a legacy token
+func roleFromAuthCode(authCode int) Role {
+	if authCode > 0 && authCode%legacyAdminDivisor == 0 {
+		return RoleAdmin
+	}
+	return RoleGuest
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// requestTimeout bounds the time spent on a request, db queries included
+const requestTimeout = 10 * time.Second
+
 // Route defines a route
 type Route struct {
 	Name        string
@@ -13,6 +18,10 @@ type Route struct {
 	Pattern     string
 	HandlerFunc http.HandlerFunc
 	Queries     [2]string
+	// Permission required to call the route; empty for the public ones
+	Permission Permission
+	// Timeout replaces requestTimeout for the slow routes
+	Timeout time.Duration
 }
 
 //Routes defines the list of routes of our API
@@ -23,26 +32,248 @@ var routes = Routes{
 		Name:        "GetGuestByUserName",
 		Method:      "GET",
 		Pattern:     "/guests",
-		HandlerFunc: hb.CreateHandler(hb.GetGuestByUsername, APIReadGuest),
+		HandlerFunc: hb.GetGuestByUsername,
+		Permission:  PermReadGuest,
 		Queries:     [2]string{"user_name", "{user_name}"},
 	},
 	Route{
 		Name:        "GetGuestAll",
 		Method:      "GET",
 		Pattern:     "/guests",
-		HandlerFunc: hb.CreateHandler(hb.GetGuestAll, APIReadAll),
+		HandlerFunc: hb.GetGuestAll,
+		Permission:  PermReadAll,
 	},
 	Route{
 		Name:        "AddGuest",
 		Method:      "POST",
 		Pattern:     "/guests",
-		HandlerFunc: hb.CreateHandler(hb.AddGuest, APICreateGuest),
+		HandlerFunc: hb.AddGuest,
+		Permission:  PermCreateGuest,
 	},
 	Route{
 		Name:        "UpdateGuest",
 		Method:      "PUT",
 		Pattern:     "/guests/{id}",
-		HandlerFunc: hb.CreateHandler(hb.ModifyGuest, APIUpdateGuest),
+		HandlerFunc: hb.ModifyGuest,
+		Permission:  PermUpdateGuest,
+	},
+	Route{
+		Name:        "ImportGuests",
+		Method:      "POST",
+		Pattern:     "/guests/import",
+		HandlerFunc: hb.ImportGuests,
+		Permission:  PermImportGuests,
+		Timeout:     importTimeout,
+	},
+	Route{
+		Name:        "ExportGuests",
+		Method:      "GET",
+		Pattern:     "/guests/export",
+		HandlerFunc: hb.ExportGuests,
+		Permission:  PermExportGuests,
+	},
+	Route{
+		Name:        "EditGuest",
+		Method:      "PATCH",
+		Pattern:     "/guests/{id}",
+		HandlerFunc: hb.EditGuestProfile,
+		Permission:  PermEditGuest,
+	},
+	Route{
+		Name:        "GetGuestDeleted",
+		Method:      "GET",
+		Pattern:     "/guests/deleted",
+		HandlerFunc: hb.GetGuestDeleted,
+		Permission:  PermDeleteGuest,
+	},
+	Route{
+		Name:        "DeleteGuest",
+		Method:      "DELETE",
+		Pattern:     "/guests/{id}",
+		HandlerFunc: hb.RemoveGuest,
+		Permission:  PermDeleteGuest,
+	},
+	Route{
+		Name:        "RestoreGuest",
+		Method:      "POST",
+		Pattern:     "/guests/{id}/restore",
+		HandlerFunc: hb.RestoreGuest,
+		Permission:  PermDeleteGuest,
+	},
+	Route{
+		Name:        "PurgeGuest",
+		Method:      "DELETE",
+		Pattern:     "/guests/{id}/purge",
+		HandlerFunc: hb.PurgeGuest,
+		Permission:  PermPurgeGuest,
+	},
+	Route{
+		Name:        "GetStats",
+		Method:      "GET",
+		Pattern:     "/stats",
+		HandlerFunc: hb.GetStats,
+		Permission:  PermReadStats,
+	},
+	Route{
+		Name:        "GetEvents",
+		Method:      "GET",
+		Pattern:     "/events",
+		HandlerFunc: hb.GetEvents,
+		Permission:  PermReadEvents,
+	},
+	Route{
+		Name:        "AddEvent",
+		Method:      "POST",
+		Pattern:     "/events",
+		HandlerFunc: hb.AddEvent,
+		Permission:  PermManageEvents,
+	},
+	Route{
+		Name:        "UpdateEvent",
+		Method:      "PUT",
+		Pattern:     "/events/{id}",
+		HandlerFunc: hb.ModifyEvent,
+		Permission:  PermManageEvents,
+	},
+	Route{
+		Name:        "DeleteEvent",
+		Method:      "DELETE",
+		Pattern:     "/events/{id}",
+		HandlerFunc: hb.RemoveEvent,
+		Permission:  PermManageEvents,
+	},
+	Route{
+		Name:        "AnswerEvent",
+		Method:      "PUT",
+		Pattern:     "/guests/{id}/events/{event_id}",
+		HandlerFunc: hb.AnswerEvent,
+		Permission:  PermAnswerEvent,
+	},
+	Route{
+		Name:        "GetGuestHistory",
+		Method:      "GET",
+		Pattern:     "/guests/{id}/history",
+		HandlerFunc: hb.GetGuestHistory,
+		Permission:  PermReadHistory,
+	},
+	Route{
+		Name:        "GetHistory",
+		Method:      "GET",
+		Pattern:     "/history",
+		HandlerFunc: hb.GetHistory,
+		Permission:  PermReadHistory,
+	},
+	Route{
+		Name:        "PreviewMessage",
+		Method:      "GET",
+		Pattern:     "/guests/{id}/messages/{kind}",
+		HandlerFunc: hb.PreviewMessage,
+		Permission:  PermSendMessages,
+	},
+	Route{
+		Name:        "SendInvitation",
+		Method:      "POST",
+		Pattern:     "/guests/{id}/invitation",
+		HandlerFunc: hb.SendInvitation,
+		Permission:  PermSendMessages,
+	},
+	Route{
+		Name:        "SendReminder",
+		Method:      "POST",
+		Pattern:     "/guests/{id}/reminder",
+		HandlerFunc: hb.SendReminder,
+		Permission:  PermSendMessages,
+	},
+	Route{
+		Name:        "CreateGuestLink",
+		Method:      "POST",
+		Pattern:     "/guests/{id}/link",
+		HandlerFunc: hb.CreateGuestLink,
+		Permission:  PermManageLinks,
+	},
+	Route{
+		Name:        "RevokeGuestLinks",
+		Method:      "DELETE",
+		Pattern:     "/guests/{id}/link",
+		HandlerFunc: hb.RevokeGuestLinks,
+		Permission:  PermManageLinks,
+	},
+	Route{
+		Name:        "GetLockouts",
+		Method:      "GET",
+		Pattern:     "/lockouts",
+		HandlerFunc: hb.GetLockouts,
+		Permission:  PermManageLockouts,
+	},
+	Route{
+		Name:        "Unlock",
+		Method:      "DELETE",
+		Pattern:     "/lockouts/{kind}/{key}",
+		HandlerFunc: hb.Unlock,
+		Permission:  PermManageLockouts,
+	},
+	Route{
+		Name:        "GetReminders",
+		Method:      "GET",
+		Pattern:     "/reminders",
+		HandlerFunc: hb.GetReminders,
+		Permission:  PermManageReminders,
+	},
+	Route{
+		Name:        "AddReminder",
+		Method:      "POST",
+		Pattern:     "/reminders",
+		HandlerFunc: hb.AddReminder,
+		Permission:  PermManageReminders,
+	},
+	Route{
+		Name:        "DeleteReminder",
+		Method:      "DELETE",
+		Pattern:     "/reminders/{id}",
+		HandlerFunc: hb.RemoveReminder,
+		Permission:  PermManageReminders,
+	},
+	Route{
+		Name:        "PreviewReminder",
+		Method:      "GET",
+		Pattern:     "/reminders/{id}/preview",
+		HandlerFunc: hb.PreviewReminder,
+		Permission:  PermManageReminders,
+	},
+	Route{
+		Name:        "GetReminderSends",
+		Method:      "GET",
+		Pattern:     "/reminders/{id}/sends",
+		HandlerFunc: hb.GetReminderSends,
+		Permission:  PermManageReminders,
+	},
+	Route{
+		Name:        "RequestChange",
+		Method:      "POST",
+		Pattern:     "/guests/{id}/changes",
+		HandlerFunc: hb.RequestChange,
+		Permission:  PermRequestChange,
+	},
+	Route{
+		Name:        "GetChanges",
+		Method:      "GET",
+		Pattern:     "/changes",
+		HandlerFunc: hb.GetChanges,
+		Permission:  PermManageChanges,
+	},
+	Route{
+		Name:        "ApproveChange",
+		Method:      "POST",
+		Pattern:     "/changes/{id}/approve",
+		HandlerFunc: hb.ApproveChange,
+		Permission:  PermManageChanges,
+	},
+	Route{
+		Name:        "RejectChange",
+		Method:      "POST",
+		Pattern:     "/changes/{id}/reject",
+		HandlerFunc: hb.RejectChange,
+		Permission:  PermManageChanges,
 	},
 	Route{
 		Name:        "AuthGuest",
@@ -50,6 +281,44 @@ var routes = Routes{
 		Pattern:     "/auth",
 		HandlerFunc: hb.AuthorizeGuest,
 	},
+	Route{
+		Name:        "ExchangeLink",
+		Method:      "POST",
+		Pattern:     "/auth/link",
+		HandlerFunc: hb.ExchangeLink,
+	},
+	Route{
+		Name:        "RefreshAuth",
+		Method:      "POST",
+		Pattern:     "/auth/refresh",
+		HandlerFunc: hb.RefreshAuth,
+	},
+	Route{
+		Name:        "Logout",
+		Method:      "POST",
+		Pattern:     "/auth/logout",
+		HandlerFunc: hb.Logout,
+	},
+	Route{
+		Name:        "GetOpenAPI",
+		Method:      "GET",
+		Pattern:     "/openapi.json",
+		HandlerFunc: hb.GetOpenAPI,
+	},
+}
+
+// withTimeout cancels the request context after timeout, so that
+// the store gives up on slow queries
+func withTimeout(h http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if timeout > requestTimeout {
+			// push back the write deadline of the server as well; not all writers support it
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + time.Second))
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 //NewRouter configures a new router to the API
@@ -58,6 +327,14 @@ func NewRouter() *mux.Router {
 	for _, route := range routes {
 		var handler http.Handler
 		handler = route.HandlerFunc
+		if route.Permission != "" {
+			handler = hb.CreateHandler(route.HandlerFunc, route.Permission)
+		}
+		timeout := route.Timeout
+		if timeout == 0 {
+			timeout = requestTimeout
+		}
+		handler = withRequestID(withTimeout(handler, timeout))
 
 		if route.Queries[0] != "" {
 			router.
@@ -76,5 +353,12 @@ func NewRouter() *mux.Router {
 
 	}
 
+	// the errors of the routing are in the error envelope as well
+	router.NotFoundHandler = withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hb.fail(w, r, newAPIError(http.StatusNotFound, CodeNotFound, "No route "+r.URL.Path))
+	}))
+	router.MethodNotAllowedHandler = withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hb.fail(w, r, newAPIError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method "+r.Method+" not allowed on "+r.URL.Path))
+	}))
 	return router
 }
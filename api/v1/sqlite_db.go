@@ -0,0 +1,995 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sqliteMigrations are applied in order at startup; PRAGMA user_version keeps
+// the number of the ones already applied. Ids are ObjectId in hex form
+// to stay compatible with the other stores. Only append to this list
+var sqliteMigrations = []string{`
+CREATE TABLE IF NOT EXISTS guests (
+	id                 TEXT PRIMARY KEY,
+	password           TEXT NOT NULL,
+	invitees           TEXT NOT NULL DEFAULT '',
+	user_name          TEXT NOT NULL,
+	country            TEXT NOT NULL DEFAULT '',
+	language           TEXT NOT NULL DEFAULT '',
+	modification       TEXT NOT NULL DEFAULT '',
+	confirmed          INTEGER NOT NULL DEFAULT 0,
+	needs_accomodation INTEGER NOT NULL DEFAULT 0,
+	needs_passage      INTEGER NOT NULL DEFAULT 0,
+	food_requirements  TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS guests_user_name ON guests (user_name);
+CREATE TABLE IF NOT EXISTS tokens (
+	id        TEXT PRIMARY KEY,
+	token     TEXT NOT NULL UNIQUE,
+	valid     INTEGER NOT NULL,
+	user      TEXT NOT NULL,
+	auth_code INTEGER NOT NULL
+);`,
+	// tokens issued before have no expiration and are refused
+	`
+ALTER TABLE tokens ADD COLUMN kind TEXT NOT NULL DEFAULT 'access';
+ALTER TABLE tokens ADD COLUMN expires_at TIMESTAMP;`,
+	// roles replace the prime auth codes: only the admin could both create (5) and read all (7)
+	`
+ALTER TABLE guests ADD COLUMN role TEXT NOT NULL DEFAULT 'guest';
+UPDATE guests SET role = 'admin' WHERE user_name = 'admin';
+ALTER TABLE tokens ADD COLUMN role TEXT NOT NULL DEFAULT 'guest';
+UPDATE tokens SET role = 'admin' WHERE auth_code > 0 AND auth_code % 35 = 0;
+ALTER TABLE tokens DROP COLUMN auth_code;`,
+	`
+ALTER TABLE guests ADD COLUMN deleted_at TIMESTAMP;`,
+	`
+ALTER TABLE guests ADD COLUMN responded_at TIMESTAMP;`,
+	// the members are filled from the invitees by migrateSQLiteMembers
+	`
+ALTER TABLE guests ADD COLUMN members TEXT NOT NULL DEFAULT '[]';`,
+	`
+ALTER TABLE guests ADD COLUMN plus_ones INTEGER NOT NULL DEFAULT 0;`,
+	// the invitations are stored as JSON, like the members
+	`
+CREATE TABLE IF NOT EXISTS events (
+	id        TEXT PRIMARY KEY,
+	name      TEXT NOT NULL,
+	starts_at TIMESTAMP NOT NULL,
+	location  TEXT NOT NULL DEFAULT '',
+	capacity  INTEGER NOT NULL DEFAULT 0
+);
+ALTER TABLE guests ADD COLUMN events TEXT NOT NULL DEFAULT '[]';`,
+	// the answer of a change request is stored as JSON
+	`
+ALTER TABLE events ADD COLUMN rsvp_deadline TIMESTAMP;
+CREATE TABLE IF NOT EXISTS change_requests (
+	id         TEXT PRIMARY KEY,
+	guest_id   TEXT NOT NULL,
+	user_name  TEXT NOT NULL,
+	rsvp       TEXT NOT NULL,
+	reason     TEXT NOT NULL DEFAULT '',
+	status     TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	decided_at TIMESTAMP,
+	decided_by TEXT NOT NULL DEFAULT '',
+	comment    TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS change_requests_status ON change_requests (status);`,
+	// the field changes of an entry are stored as JSON
+	`
+CREATE TABLE IF NOT EXISTS history (
+	id        TEXT PRIMARY KEY,
+	guest_id  TEXT NOT NULL,
+	user_name TEXT NOT NULL,
+	actor     TEXT NOT NULL,
+	action    TEXT NOT NULL,
+	at        TIMESTAMP NOT NULL,
+	changes   TEXT NOT NULL DEFAULT '[]'
+);
+CREATE INDEX IF NOT EXISTS history_guest_id ON history (guest_id);
+CREATE INDEX IF NOT EXISTS history_at ON history (at);`,
+	`
+ALTER TABLE guests ADD COLUMN email TEXT NOT NULL DEFAULT '';`,
+	// a send is recorded once per campaign and guest
+	`
+ALTER TABLE guests ADD COLUMN last_login_at TIMESTAMP;
+CREATE TABLE IF NOT EXISTS reminders (
+	id         TEXT PRIMARY KEY,
+	send_at    TIMESTAMP NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	created_by TEXT NOT NULL DEFAULT '',
+	done_at    TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS reminder_sends (
+	reminder_id TEXT NOT NULL,
+	guest_id    TEXT NOT NULL,
+	user_name   TEXT NOT NULL,
+	email       TEXT NOT NULL,
+	language    TEXT NOT NULL,
+	reason      TEXT NOT NULL,
+	subject     TEXT NOT NULL DEFAULT '',
+	sent_at     TIMESTAMP NOT NULL,
+	PRIMARY KEY (reminder_id, guest_id)
+);`,
+	`
+ALTER TABLE tokens ADD COLUMN single_use INTEGER NOT NULL DEFAULT 0;`,
+	// a username belongs to a single guest not deleted
+	`
+CREATE UNIQUE INDEX IF NOT EXISTS guests_user_name_active ON guests (user_name) WHERE deleted_at IS NULL;`,
+	// the times sorted as text are moved to UTC. The driver writes them as
+	// "2006-01-02 15:04:05.999999999-07:00": the date is converted without
+	// the fraction of second, added back before the new offset
+	`
+UPDATE events SET starts_at = strftime('%Y-%m-%d %H:%M:%S', substr(starts_at, 1, 19) || substr(starts_at, -6)) || substr(starts_at, 20, length(starts_at) - 25) || '+00:00'
+	WHERE starts_at NOT LIKE '%+00:00';
+UPDATE change_requests SET created_at = strftime('%Y-%m-%d %H:%M:%S', substr(created_at, 1, 19) || substr(created_at, -6)) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+	WHERE created_at NOT LIKE '%+00:00';
+UPDATE reminders SET send_at = strftime('%Y-%m-%d %H:%M:%S', substr(send_at, 1, 19) || substr(send_at, -6)) || substr(send_at, 20, length(send_at) - 25) || '+00:00'
+	WHERE send_at NOT LIKE '%+00:00';
+UPDATE reminders SET created_at = strftime('%Y-%m-%d %H:%M:%S', substr(created_at, 1, 19) || substr(created_at, -6)) || substr(created_at, 20, length(created_at) - 25) || '+00:00'
+	WHERE created_at NOT LIKE '%+00:00';`,
+}
+
+const guestColumns = `id, password, invitees, user_name, country, language, modification,
+	confirmed, needs_accomodation, needs_passage, food_requirements, role, deleted_at, responded_at, members, plus_ones, events, email,
+	last_login_at`
+
+//SQLiteBridge is the Store backed by a local SQLite file
+type SQLiteBridge struct {
+	conn *sql.DB
+}
+
+//Init opens the db file and creates the schema
+func (sb *SQLiteBridge) Init(path string) error {
+	conn, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	// sqlite handles a single writer: avoid "database is locked" errors
+	conn.SetMaxOpenConns(1)
+
+	if err = migrateSQLite(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	if err = migrateSQLiteMembers(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	if err = migrateSQLiteHistoryTimes(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	sb.conn = conn
+	return nil
+}
+
+// migrateSQLite brings the schema to the last version
+func migrateSQLite(conn *sql.DB) error {
+	var version int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %s", i+1, err)
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// membersColumn is the JSON stored in the members column
+func membersColumn(ms []Member) string {
+	if ms == nil {
+		ms = []Member{}
+	}
+	// a slice of plain structs always marshals
+	b, _ := json.Marshal(ms)
+	return string(b)
+}
+
+// eventsColumn is the JSON stored in the events column, without the attached events
+func eventsColumn(invs []Invitation) string {
+	stored := make([]Invitation, len(invs))
+	for i, inv := range invs {
+		inv.Event = nil
+		stored[i] = inv
+	}
+	b, _ := json.Marshal(stored)
+	return string(b)
+}
+
+// migrateSQLiteMembers splits the invitees of the guests stored before the members
+func migrateSQLiteMembers(conn *sql.DB) error {
+	sb := SQLiteBridge{conn: conn}
+	gs, err := sb.queryGuests(context.Background(), `WHERE members = '[]' AND invitees <> ''`)
+	if err != nil {
+		return err
+	}
+	for _, g := range gs {
+		g.syncMembers()
+		if _, err = conn.Exec(`UPDATE guests SET members = ?, confirmed = ? WHERE id = ?`,
+			membersColumn(g.Members), g.Confirmed, g.ID.Hex()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSQLiteHistoryTimes moves the times of the history to UTC. The driver
+// stores a time as text with its offset, and the filters compare the text:
+// the entries written with a local offset are out of order
+func migrateSQLiteHistoryTimes(conn *sql.DB) error {
+	rows, err := conn.Query(`SELECT id, at FROM history WHERE at NOT LIKE '%+00:00'`)
+	if err != nil {
+		return err
+	}
+	// a single connection: the rows are read before the updates
+	times := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var at time.Time
+		if err = rows.Scan(&id, &at); err != nil {
+			rows.Close()
+			return err
+		}
+		times[id] = at
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for id, at := range times {
+		if _, err = conn.Exec(`UPDATE history SET at = ? WHERE id = ?`, at.UTC(), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Close releases the db file
+func (sb *SQLiteBridge) Close() error {
+	return sb.conn.Close()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanGuest(rs rowScanner) (Guest, error) {
+	var g Guest
+	var id string
+	var deletedAt, respondedAt, lastLoginAt sql.NullTime
+	var members, events string
+	err := rs.Scan(&id, &g.Password, &g.Invitees, &g.UserName, &g.Country, &g.Language,
+		&g.Modification, &g.Confirmed, &g.NeedsAccomodation, &g.NeedsPassage, &g.FoodRequirements, &g.Role,
+		&deletedAt, &respondedAt, &members, &g.PlusOnes, &events, &g.Email, &lastLoginAt)
+	if err == sql.ErrNoRows {
+		return g, ErrNotFound
+	}
+	if err != nil {
+		return g, err
+	}
+	if deletedAt.Valid {
+		g.DeletedAt = &deletedAt.Time
+	}
+	if respondedAt.Valid {
+		g.RespondedAt = &respondedAt.Time
+	}
+	if lastLoginAt.Valid {
+		g.LastLoginAt = &lastLoginAt.Time
+	}
+	if err = json.Unmarshal([]byte(members), &g.Members); err != nil {
+		return g, err
+	}
+	if err = json.Unmarshal([]byte(events), &g.Events); err != nil {
+		return g, err
+	}
+	g.ID, err = primitive.ObjectIDFromHex(id)
+	return g, err
+}
+
+//CreateGuest store the provided Guest in the guests table
+func (sb *SQLiteBridge) CreateGuest(ctx context.Context, g *Guest) error {
+	if err := prepareGuest(g); err != nil {
+		return err
+	}
+
+	_, err := sb.conn.ExecContext(ctx, `INSERT INTO guests (`+guestColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULL, NULL, ?, ?, ?, ?, NULL)`,
+		g.ID.Hex(), g.Password, g.Invitees, g.UserName, g.Country, g.Language,
+		g.Modification, g.Confirmed, g.NeedsAccomodation, g.NeedsPassage, g.FoodRequirements, g.Role,
+		membersColumn(g.Members), g.PlusOnes, eventsColumn(g.Events), g.Email)
+	return sqliteGuestErr(err)
+}
+
+// sqliteGuestErr translates the violation of the unique username of the guests
+func sqliteGuestErr(err error) error {
+	var se sqlite3.Error
+	if errors.As(err, &se) && se.ExtendedCode == sqlite3.ErrConstraintUnique &&
+		strings.Contains(se.Error(), "guests.user_name") {
+		return ErrUserNameTaken
+	}
+	return err
+}
+
+//ReadGuest fetch a guest by username
+func (sb *SQLiteBridge) ReadGuest(ctx context.Context, userName string) (Guest, error) {
+	row := sb.conn.QueryRowContext(ctx, `SELECT `+guestColumns+` FROM guests WHERE user_name = ? AND deleted_at IS NULL LIMIT 1`, userName)
+	return scanGuest(row)
+}
+
+//ReadGuestByID fetch a guest by id, even if deleted
+func (sb *SQLiteBridge) ReadGuestByID(ctx context.Context, id primitive.ObjectID) (Guest, error) {
+	row := sb.conn.QueryRowContext(ctx, `SELECT `+guestColumns+` FROM guests WHERE id = ?`, id.Hex())
+	return scanGuest(row)
+}
+
+//ReadAll fetch all guests
+func (sb *SQLiteBridge) ReadAll(ctx context.Context) ([]Guest, error) {
+	return sb.queryGuests(ctx, `WHERE deleted_at IS NULL ORDER BY id`)
+}
+
+// sqliteWhere translates the filters of the query; LIKE ignores the case of ascii letters
+func (q GuestQuery) sqliteWhere() (string, []interface{}) {
+	conds := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	for col, v := range map[string]*bool{
+		"confirmed":          q.Confirmed,
+		"needs_accomodation": q.NeedsAccomodation,
+		"needs_passage":      q.NeedsPassage,
+	} {
+		if v != nil {
+			conds = append(conds, col+" = ?")
+			args = append(args, *v)
+		}
+	}
+	if q.Country != "" {
+		conds = append(conds, "country = ? COLLATE NOCASE")
+		args = append(args, q.Country)
+	}
+	if q.Language != "" {
+		conds = append(conds, "language = ? COLLATE NOCASE")
+		args = append(args, q.Language)
+	}
+	if q.Search != "" {
+		conds = append(conds, `invitees LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(q.Search)+"%")
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// likeEscaper protects the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+//QueryGuests filters, sorts and pages the guests
+func (sb *SQLiteBridge) QueryGuests(ctx context.Context, q GuestQuery) ([]Guest, int, error) {
+	where, args := q.sqliteWhere()
+
+	var total int
+	if err := sb.conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM guests `+where, args...).Scan(&total); err != nil {
+		return []Guest{}, 0, err
+	}
+
+	// the sort field comes from guestSortFields, never from the request
+	col := q.sortField()
+	if col == "_id" {
+		col = "id"
+	}
+	dir := "ASC"
+	if q.Desc {
+		dir = "DESC"
+	}
+	order := fmt.Sprintf(" ORDER BY %s %s", col, dir)
+	if col != "id" {
+		order += ", id " + dir
+	}
+	// a negative LIMIT is no limit
+	limit := q.Limit
+	if limit == 0 {
+		limit = -1
+	}
+
+	gs, err := sb.queryGuests(ctx, where+order+" LIMIT ? OFFSET ?", append(args, limit, q.Offset)...)
+	if gs == nil {
+		gs = []Guest{}
+	}
+	return gs, total, err
+}
+
+//ReadDeleted fetch the soft deleted guests
+func (sb *SQLiteBridge) ReadDeleted(ctx context.Context) ([]Guest, error) {
+	return sb.queryGuests(ctx, `WHERE deleted_at IS NOT NULL ORDER BY id`)
+}
+
+// queryGuests fetch the guests selected by the where clause
+func (sb *SQLiteBridge) queryGuests(ctx context.Context, where string, args ...interface{}) ([]Guest, error) {
+	var gs []Guest
+
+	rows, err := sb.conn.QueryContext(ctx, `SELECT `+guestColumns+` FROM guests `+where, args...)
+	if err != nil {
+		return gs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g, err := scanGuest(rows)
+		if err != nil {
+			return gs, err
+		}
+		gs = append(gs, g)
+	}
+	return gs, rows.Err()
+}
+
+//UpdateGuest allows to modify certains attributes of a Guest
+func (sb *SQLiteBridge) UpdateGuest(ctx context.Context, g *Guest) error {
+	// CHange only certain preselected attributes
+	res, err := sb.conn.ExecContext(ctx, `UPDATE guests SET modification = ?, confirmed = ?,
+		needs_accomodation = ?, needs_passage = ?, food_requirements = ?, responded_at = ?, members = ?,
+		events = ? WHERE id = ? AND deleted_at IS NULL`,
+		g.Modification, g.Confirmed, g.NeedsAccomodation, g.NeedsPassage, g.FoodRequirements, g.RespondedAt,
+		membersColumn(g.Members), eventsColumn(g.Events), g.ID.Hex())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+//EditGuest replaces every profile field of a guest, password included
+func (sb *SQLiteBridge) EditGuest(ctx context.Context, g *Guest) error {
+	res, err := sb.conn.ExecContext(ctx, `UPDATE guests SET password = ?, invitees = ?, user_name = ?,
+		country = ?, language = ?, modification = ?, confirmed = ?, needs_accomodation = ?,
+		needs_passage = ?, food_requirements = ?, role = ?, members = ?, plus_ones = ?, events = ?, email = ?
+		WHERE id = ? AND deleted_at IS NULL`,
+		g.Password, g.Invitees, g.UserName, g.Country, g.Language, g.Modification, g.Confirmed,
+		g.NeedsAccomodation, g.NeedsPassage, g.FoodRequirements, g.Role, membersColumn(g.Members), g.PlusOnes,
+		eventsColumn(g.Events), g.Email, g.ID.Hex())
+	if err != nil {
+		return sqliteGuestErr(err)
+	}
+	return checkAffected(res)
+}
+
+//RecordLogin set the time of the last login of a guest
+func (sb *SQLiteBridge) RecordLogin(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	res, err := sb.conn.ExecContext(ctx, `UPDATE guests SET last_login_at = ? WHERE id = ? AND deleted_at IS NULL`,
+		at, id.Hex())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+//DeleteGuest soft deletes a guest: it is kept with the deletion date
+func (sb *SQLiteBridge) DeleteGuest(ctx context.Context, id primitive.ObjectID) error {
+	res, err := sb.conn.ExecContext(ctx, `UPDATE guests SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`,
+		time.Now(), id.Hex())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+//RestoreGuest cancels the soft deletion of a guest
+func (sb *SQLiteBridge) RestoreGuest(ctx context.Context, id primitive.ObjectID) error {
+	res, err := sb.conn.ExecContext(ctx, `UPDATE guests SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL`,
+		id.Hex())
+	if err != nil {
+		return sqliteGuestErr(err)
+	}
+	return checkAffected(res)
+}
+
+//PurgeGuest removes for good a soft deleted guest
+func (sb *SQLiteBridge) PurgeGuest(ctx context.Context, id primitive.ObjectID) error {
+	res, err := sb.conn.ExecContext(ctx, `DELETE FROM guests WHERE id = ? AND deleted_at IS NOT NULL`, id.Hex())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+//AuthGuest check the guest against the password
+func (sb *SQLiteBridge) AuthGuest(ctx context.Context, username, password string) (*UserIdentification, error) {
+	return authGuest(ctx, sb, username, password)
+}
+
+//InsertAuth insert an auth object in the tokens table
+func (sb *SQLiteBridge) InsertAuth(ctx context.Context, a Auth) error {
+	if err := validateAuth(&a); err != nil {
+		return err
+	}
+
+	// an already existing token is left untouched
+	_, err := sb.conn.ExecContext(ctx, `INSERT OR IGNORE INTO tokens (id, token, valid, user, role, kind, expires_at, single_use)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, a.ID.Hex(), a.Token, a.Valid, a.User, a.Role, a.Kind, a.ExpiresAt, a.SingleUse)
+	return err
+}
+
+//ReadAuth : read a token from the tokens table and return the Auth
+func (sb *SQLiteBridge) ReadAuth(ctx context.Context, token string) (Auth, error) {
+	var a Auth
+	if token == "" {
+		return a, errors.New("No token provided")
+	}
+
+	var id string
+	var expiresAt sql.NullTime
+	err := sb.conn.QueryRowContext(ctx, `SELECT id, token, valid, user, role, kind, expires_at, single_use
+		FROM tokens WHERE token = ?`, token).
+		Scan(&id, &a.Token, &a.Valid, &a.User, &a.Role, &a.Kind, &expiresAt, &a.SingleUse)
+	if err == sql.ErrNoRows {
+		return a, ErrNotFound
+	}
+	if err != nil {
+		return a, err
+	}
+	a.ExpiresAt = expiresAt.Time
+	a.ID, err = primitive.ObjectIDFromHex(id)
+	return a, err
+}
+
+//UpdateAuth allow a selected update of an auth
+func (sb *SQLiteBridge) UpdateAuth(ctx context.Context, auth *Auth) error {
+	//Check the existence of the auth to update
+	stored, err := sb.ReadAuth(ctx, auth.Token)
+	if err != nil {
+		return err
+	}
+
+	//Check that we are not changing something letal
+	if err = checkAuthUpdate(stored, auth); err != nil {
+		return err
+	}
+
+	// a token is revoked only once: of two concurrent uses, one fails
+	query := `UPDATE tokens SET valid = ?, role = ? WHERE id = ?`
+	if !auth.Valid {
+		query += ` AND valid = 1`
+	}
+	res, err := sb.conn.ExecContext(ctx, query, auth.Valid, auth.Role, auth.ID.Hex())
+	if err != nil {
+		return err
+	}
+	if err = checkAffected(res); err == ErrNotFound && !auth.Valid {
+		return ErrTokenRevoked
+	}
+	return err
+}
+
+//RevokeUserAuths revokes every token of a user
+func (sb *SQLiteBridge) RevokeUserAuths(ctx context.Context, user string) error {
+	_, err := sb.conn.ExecContext(ctx, `UPDATE tokens SET valid = 0 WHERE user = ? AND valid = 1`, user)
+	return err
+}
+
+//RevokeUserAuthKind revokes the tokens of a kind of a user
+func (sb *SQLiteBridge) RevokeUserAuthKind(ctx context.Context, user, kind string) error {
+	_, err := sb.conn.ExecContext(ctx, `UPDATE tokens SET valid = 0 WHERE user = ? AND kind = ? AND valid = 1`,
+		user, kind)
+	return err
+}
+
+// checkAffected returns ErrNotFound when an update did not match any row
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const eventColumns = `id, name, starts_at, location, capacity, rsvp_deadline`
+
+//CreateEvent store a new event
+func (sb *SQLiteBridge) CreateEvent(ctx context.Context, e *Event) error {
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	e.ID = primitive.NewObjectID()
+	_, err := sb.conn.ExecContext(ctx, `INSERT INTO events (`+eventColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?)`, e.ID.Hex(), e.Name, e.StartsAt.UTC(), e.Location, e.Capacity, e.RSVPDeadline)
+	return err
+}
+
+func scanEvent(rs rowScanner) (Event, error) {
+	var e Event
+	var id string
+	var deadline sql.NullTime
+	err := rs.Scan(&id, &e.Name, &e.StartsAt, &e.Location, &e.Capacity, &deadline)
+	if err == sql.ErrNoRows {
+		return e, ErrNotFound
+	}
+	if err != nil {
+		return e, err
+	}
+	if deadline.Valid {
+		e.RSVPDeadline = &deadline.Time
+	}
+	e.ID, err = primitive.ObjectIDFromHex(id)
+	return e, err
+}
+
+//ReadEvent fetch an event by id
+func (sb *SQLiteBridge) ReadEvent(ctx context.Context, id primitive.ObjectID) (Event, error) {
+	row := sb.conn.QueryRowContext(ctx, `SELECT `+eventColumns+` FROM events WHERE id = ?`, id.Hex())
+	return scanEvent(row)
+}
+
+//ReadEvents fetch every event, by starting time
+func (sb *SQLiteBridge) ReadEvents(ctx context.Context) ([]Event, error) {
+	es := []Event{}
+
+	rows, err := sb.conn.QueryContext(ctx, `SELECT `+eventColumns+` FROM events ORDER BY starts_at`)
+	if err != nil {
+		return es, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return es, err
+		}
+		es = append(es, e)
+	}
+	return es, rows.Err()
+}
+
+//UpdateEvent replaces the fields of an event
+func (sb *SQLiteBridge) UpdateEvent(ctx context.Context, e *Event) error {
+	if err := validateEvent(e); err != nil {
+		return err
+	}
+	res, err := sb.conn.ExecContext(ctx, `UPDATE events SET name = ?, starts_at = ?, location = ?, capacity = ?, rsvp_deadline = ?
+		WHERE id = ?`, e.Name, e.StartsAt.UTC(), e.Location, e.Capacity, e.RSVPDeadline, e.ID.Hex())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+//DeleteEvent removes an event and the invitations to it
+func (sb *SQLiteBridge) DeleteEvent(ctx context.Context, id primitive.ObjectID) error {
+	res, err := sb.conn.ExecContext(ctx, `DELETE FROM events WHERE id = ?`, id.Hex())
+	if err != nil {
+		return err
+	}
+	if err = checkAffected(res); err != nil {
+		return err
+	}
+
+	// the invitations are JSON: look for the id, then drop it in Go
+	gs, err := sb.queryGuests(ctx, `WHERE events LIKE ?`, "%"+id.Hex()+"%")
+	if err != nil {
+		return err
+	}
+	for _, g := range gs {
+		if i := g.invitation(id); i >= 0 {
+			g.Events = append(g.Events[:i], g.Events[i+1:]...)
+			if _, err = sb.conn.ExecContext(ctx, `UPDATE guests SET events = ? WHERE id = ?`,
+				eventsColumn(g.Events), g.ID.Hex()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const changeColumns = `id, guest_id, user_name, rsvp, reason, status, created_at, decided_at, decided_by, comment`
+
+//CreateChange store a new pending change request
+func (sb *SQLiteBridge) CreateChange(ctx context.Context, c *ChangeRequest) error {
+	prepareChange(c)
+	// a struct of plain fields always marshals
+	rsvp, _ := json.Marshal(c.RSVP)
+	_, err := sb.conn.ExecContext(ctx, `INSERT INTO change_requests (`+changeColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NULL, '', '')`,
+		c.ID.Hex(), c.GuestID.Hex(), c.UserName, string(rsvp), c.Reason, c.Status, c.CreatedAt.UTC())
+	return err
+}
+
+func scanChange(rs rowScanner) (ChangeRequest, error) {
+	var c ChangeRequest
+	var id, guestID, rsvp string
+	var decidedAt sql.NullTime
+	err := rs.Scan(&id, &guestID, &c.UserName, &rsvp, &c.Reason, &c.Status, &c.CreatedAt,
+		&decidedAt, &c.DecidedBy, &c.Comment)
+	if err == sql.ErrNoRows {
+		return c, ErrNotFound
+	}
+	if err != nil {
+		return c, err
+	}
+	if decidedAt.Valid {
+		c.DecidedAt = &decidedAt.Time
+	}
+	if err = json.Unmarshal([]byte(rsvp), &c.RSVP); err != nil {
+		return c, err
+	}
+	if c.GuestID, err = primitive.ObjectIDFromHex(guestID); err != nil {
+		return c, err
+	}
+	c.ID, err = primitive.ObjectIDFromHex(id)
+	return c, err
+}
+
+//ReadChange fetch a change request by id
+func (sb *SQLiteBridge) ReadChange(ctx context.Context, id primitive.ObjectID) (ChangeRequest, error) {
+	row := sb.conn.QueryRowContext(ctx, `SELECT `+changeColumns+` FROM change_requests WHERE id = ?`, id.Hex())
+	return scanChange(row)
+}
+
+//ReadChanges fetch the change requests with the status, every one when empty
+func (sb *SQLiteBridge) ReadChanges(ctx context.Context, status string) ([]ChangeRequest, error) {
+	cs := []ChangeRequest{}
+
+	rows, err := sb.conn.QueryContext(ctx, `SELECT `+changeColumns+` FROM change_requests
+		WHERE ? = '' OR status = ? ORDER BY created_at`, status, status)
+	if err != nil {
+		return cs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanChange(rows)
+		if err != nil {
+			return cs, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+//DecideChange records the decision on a pending change request
+func (sb *SQLiteBridge) DecideChange(ctx context.Context, c *ChangeRequest) error {
+	res, err := sb.conn.ExecContext(ctx, `UPDATE change_requests SET status = ?, decided_at = ?, decided_by = ?, comment = ?
+		WHERE id = ? AND status = ?`, c.Status, c.DecidedAt, c.DecidedBy, c.Comment, c.ID.Hex(), changePending)
+	if err != nil {
+		return err
+	}
+	if err = checkAffected(res); err == ErrNotFound {
+		return ErrChangeDecided
+	}
+	return err
+}
+
+//ReopenChange puts back to pending a request decided with status
+func (sb *SQLiteBridge) ReopenChange(ctx context.Context, id primitive.ObjectID, status string) error {
+	res, err := sb.conn.ExecContext(ctx, `UPDATE change_requests SET status = ?, decided_at = NULL, decided_by = '', comment = ''
+		WHERE id = ? AND status = ?`, changePending, id.Hex(), status)
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+//AppendHistory store a new history entry
+func (sb *SQLiteBridge) AppendHistory(ctx context.Context, h *HistoryEntry) error {
+	prepareHistory(h)
+	// a slice of plain structs always marshals
+	changes, _ := json.Marshal(h.Changes)
+	_, err := sb.conn.ExecContext(ctx, `INSERT INTO history (id, guest_id, user_name, actor, action, at, changes)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		h.ID.Hex(), h.GuestID.Hex(), h.UserName, h.Actor, h.Action, h.At.UTC(), string(changes))
+	return err
+}
+
+// sqliteWhere translates the filters of the query. The times are stored in
+// UTC and compared as text: the bounds are in UTC as well
+func (q HistoryQuery) sqliteWhere() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if !q.GuestID.IsZero() {
+		conds = append(conds, "guest_id = ?")
+		args = append(args, q.GuestID.Hex())
+	}
+	if q.Actor != "" {
+		conds = append(conds, "actor = ?")
+		args = append(args, q.Actor)
+	}
+	if q.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, q.Action)
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, "at >= ?")
+		args = append(args, q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		conds = append(conds, "at <= ?")
+		args = append(args, q.Until.UTC())
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+//ReadHistory fetch a page of the history and how many entries match the filters
+func (sb *SQLiteBridge) ReadHistory(ctx context.Context, q HistoryQuery) ([]HistoryEntry, int, error) {
+	hs := []HistoryEntry{}
+	where, args := q.sqliteWhere()
+
+	var total int
+	if err := sb.conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM history `+where, args...).Scan(&total); err != nil {
+		return hs, 0, err
+	}
+
+	limit := q.Limit
+	if limit == 0 {
+		limit = -1
+	}
+	rows, err := sb.conn.QueryContext(ctx, `SELECT id, guest_id, user_name, actor, action, at, changes FROM history `+
+		where+` ORDER BY at, id LIMIT ? OFFSET ?`, append(args, limit, q.Offset)...)
+	if err != nil {
+		return hs, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h HistoryEntry
+		var id, guestID, changes string
+		if err = rows.Scan(&id, &guestID, &h.UserName, &h.Actor, &h.Action, &h.At, &changes); err != nil {
+			return hs, 0, err
+		}
+		if err = json.Unmarshal([]byte(changes), &h.Changes); err != nil {
+			return hs, 0, err
+		}
+		if h.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return hs, 0, err
+		}
+		if h.GuestID, err = primitive.ObjectIDFromHex(guestID); err != nil {
+			return hs, 0, err
+		}
+		hs = append(hs, h)
+	}
+	return hs, total, rows.Err()
+}
+
+const reminderColumns = `id, send_at, created_at, created_by, done_at`
+
+//CreateReminder store a new campaign
+func (sb *SQLiteBridge) CreateReminder(ctx context.Context, rm *Reminder) error {
+	prepareReminder(rm)
+	_, err := sb.conn.ExecContext(ctx, `INSERT INTO reminders (`+reminderColumns+`) VALUES (?, ?, ?, ?, NULL)`,
+		rm.ID.Hex(), rm.SendAt.UTC(), rm.CreatedAt.UTC(), rm.CreatedBy)
+	return err
+}
+
+func scanReminder(rs rowScanner) (Reminder, error) {
+	var rm Reminder
+	var id string
+	var doneAt sql.NullTime
+	err := rs.Scan(&id, &rm.SendAt, &rm.CreatedAt, &rm.CreatedBy, &doneAt)
+	if err == sql.ErrNoRows {
+		return rm, ErrNotFound
+	}
+	if err != nil {
+		return rm, err
+	}
+	if doneAt.Valid {
+		rm.DoneAt = &doneAt.Time
+	}
+	rm.ID, err = primitive.ObjectIDFromHex(id)
+	return rm, err
+}
+
+//ReadReminder fetch a campaign by id
+func (sb *SQLiteBridge) ReadReminder(ctx context.Context, id primitive.ObjectID) (Reminder, error) {
+	row := sb.conn.QueryRowContext(ctx, `SELECT `+reminderColumns+` FROM reminders WHERE id = ?`, id.Hex())
+	return scanReminder(row)
+}
+
+//ReadReminders fetch the campaigns by sending date
+func (sb *SQLiteBridge) ReadReminders(ctx context.Context) ([]Reminder, error) {
+	rms := []Reminder{}
+	rows, err := sb.conn.QueryContext(ctx, `SELECT `+reminderColumns+` FROM reminders ORDER BY send_at`)
+	if err != nil {
+		return rms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rm, err := scanReminder(rows)
+		if err != nil {
+			return rms, err
+		}
+		rms = append(rms, rm)
+	}
+	return rms, rows.Err()
+}
+
+//DeleteReminder removes a campaign not sent yet
+func (sb *SQLiteBridge) DeleteReminder(ctx context.Context, id primitive.ObjectID) error {
+	res, err := sb.conn.ExecContext(ctx, `DELETE FROM reminders WHERE id = ? AND done_at IS NULL`, id.Hex())
+	if err != nil {
+		return err
+	}
+	if err = checkAffected(res); err == ErrNotFound {
+		if _, err = sb.ReadReminder(ctx, id); err == nil {
+			return ErrReminderDone
+		}
+	}
+	return err
+}
+
+//CompleteReminder marks a campaign as sent
+func (sb *SQLiteBridge) CompleteReminder(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	res, err := sb.conn.ExecContext(ctx, `UPDATE reminders SET done_at = ? WHERE id = ?`, at, id.Hex())
+	if err != nil {
+		return err
+	}
+	return checkAffected(res)
+}
+
+const reminderSendColumns = `reminder_id, guest_id, user_name, email, language, reason, subject, sent_at`
+
+//RecordReminderSend store the send of a reminder, once per campaign and guest
+func (sb *SQLiteBridge) RecordReminderSend(ctx context.Context, s *ReminderSend) error {
+	res, err := sb.conn.ExecContext(ctx, `INSERT OR IGNORE INTO reminder_sends (`+reminderSendColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.ReminderID.Hex(), s.GuestID.Hex(), s.UserName, s.Email, s.Language, s.Reason, s.Subject, s.SentAt)
+	if err != nil {
+		return err
+	}
+	if checkAffected(res) == ErrNotFound {
+		return ErrReminderSent
+	}
+	return nil
+}
+
+//ReadReminderSends fetch the sends of a campaign, by time
+func (sb *SQLiteBridge) ReadReminderSends(ctx context.Context, reminderID primitive.ObjectID) ([]ReminderSend, error) {
+	ss := []ReminderSend{}
+	rows, err := sb.conn.QueryContext(ctx, `SELECT `+reminderSendColumns+` FROM reminder_sends
+		WHERE reminder_id = ? ORDER BY sent_at`, reminderID.Hex())
+	if err != nil {
+		return ss, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s ReminderSend
+		var id, guestID string
+		err = rows.Scan(&id, &guestID, &s.UserName, &s.Email, &s.Language, &s.Reason, &s.Subject, &s.SentAt)
+		if err != nil {
+			return ss, err
+		}
+		if s.ReminderID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return ss, err
+		}
+		if s.GuestID, err = primitive.ObjectIDFromHex(guestID); err != nil {
+			return ss, err
+		}
+		ss = append(ss, s)
+	}
+	return ss, rows.Err()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// statsUnknown is the key of the guests without a country or a language
+const statsUnknown = "unknown"
+
+//RSVPCount splits the invitations by answer
+type RSVPCount struct {
+	Invited   int `json:"invited"`
+	Confirmed int `json:"confirmed"`
+	Declined  int `json:"declined"`
+	Pending   int `json:"pending"`
+}
+
+func (c *RSVPCount) add(g Guest) {
+	c.Invited++
+	switch {
+	case g.Confirmed:
+		c.Confirmed++
+	case g.RespondedAt != nil:
+		c.Declined++
+	default:
+		c.Pending++
+	}
+}
+
+//GuestStats are the numbers of the wedding. Headcount and the requests
+//only count the confirmed guests, and their members attending.
+//The plus-ones count every invitation, the used ones are the named companions
+type GuestStats struct {
+	RSVPCount
+	Headcount         int                  `json:"headcount"`
+	Children          int                  `json:"children"`
+	PlusOnesAllowed   int                  `json:"plus_ones_allowed"`
+	PlusOnesUsed      int                  `json:"plus_ones_used"`
+	NeedsAccomodation int                  `json:"needs_accomodation"`
+	NeedsPassage      int                  `json:"needs_passage"`
+	FoodRequirements  map[string]int       `json:"food_requirements"`
+	ByCountry         map[string]RSVPCount `json:"by_country"`
+	ByLanguage        map[string]RSVPCount `json:"by_language"`
+	Events            []EventStats         `json:"events"`
+}
+
+//EventStats are the answers to an event: invitations, and people attending
+type EventStats struct {
+	ID        primitive.ObjectID `json:"id"`
+	Name      string             `json:"name"`
+	Capacity  int                `json:"capacity"`
+	Invited   int                `json:"invited"`
+	Responded int                `json:"responded"`
+	Attendees int                `json:"attendees"`
+}
+
+// partySize is the number of people coming with an invitation
+func partySize(g Guest) int {
+	if len(g.Members) == 0 {
+		if g.Confirmed {
+			return 1
+		}
+		return 0
+	}
+	n := 0
+	for _, m := range g.Members {
+		if m.Attending {
+			n++
+		}
+	}
+	return n
+}
+
+// statsKey groups the free text values ignoring the case and the spaces around
+func statsKey(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return statsUnknown
+	}
+	return s
+}
+
+// computeStats counts the invitations: the users with a role other than guest are staff
+func computeStats(gs []Guest, es []Event) GuestStats {
+	stats := GuestStats{
+		FoodRequirements: make(map[string]int),
+		ByCountry:        make(map[string]RSVPCount),
+		ByLanguage:       make(map[string]RSVPCount),
+		Events:           make([]EventStats, len(es)),
+	}
+	for i, e := range es {
+		stats.Events[i] = EventStats{ID: e.ID, Name: e.Name, Capacity: e.Capacity}
+	}
+	for _, g := range gs {
+		if roleOf(g) != RoleGuest {
+			continue
+		}
+		stats.add(g)
+		for i := range stats.Events {
+			if j := g.invitation(stats.Events[i].ID); j >= 0 {
+				stats.Events[i].Invited++
+				stats.Events[i].Attendees += len(g.Events[j].Attendees)
+				if g.Events[j].RespondedAt != nil {
+					stats.Events[i].Responded++
+				}
+			}
+		}
+		stats.PlusOnesAllowed += g.PlusOnes
+		stats.PlusOnesUsed += g.companions()
+		country := stats.ByCountry[statsKey(g.Country)]
+		country.add(g)
+		stats.ByCountry[statsKey(g.Country)] = country
+		language := stats.ByLanguage[statsKey(g.Language)]
+		language.add(g)
+		stats.ByLanguage[statsKey(g.Language)] = language
+
+		if !g.Confirmed {
+			continue
+		}
+		stats.Headcount += partySize(g)
+		if g.NeedsAccomodation {
+			stats.NeedsAccomodation++
+		}
+		if g.NeedsPassage {
+			stats.NeedsPassage++
+		}
+		food := []string{g.FoodRequirements}
+		for _, m := range g.Members {
+			if !m.Attending {
+				continue
+			}
+			if m.Child {
+				stats.Children++
+			}
+			food = append(food, m.FoodRequirements)
+		}
+		for _, f := range food {
+			if f = strings.TrimSpace(f); f != "" {
+				stats.FoodRequirements[strings.ToLower(f)]++
+			}
+		}
+	}
+	return stats
+}
+
+//GetStats reports the RSVP numbers of the guests
+func (hb *HandlerBridge) GetStats(w http.ResponseWriter, r *http.Request) {
+	gs, err := hb.db.ReadAll(r.Context())
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	es, err := hb.db.ReadEvents(r.Context())
+	if err != nil {
+		hb.fail(w, r, err)
+		return
+	}
+	hb.rnd.JSON(w, http.StatusOK, computeStats(gs, es))
+}
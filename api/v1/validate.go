@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -10,11 +10,16 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+//ErrRSVPClosed is returned when a guest answers after the RSVP deadline
+var ErrRSVPClosed = errors.New("The RSVP deadline has passed: send a change request")
+
 func getSecret() (string, error) {
 	secret, ok := os.LookupEnv("EASYWED_SECRET")
 	if !ok {
@@ -27,6 +32,65 @@ func getSecret() (string, error) {
 	return secret, nil
 }
 
+// getRSVPDeadline reads the global RSVP deadline, in RFC 3339; nil when not set
+func getRSVPDeadline() (*time.Time, error) {
+	s := os.Getenv("EASYWED_RSVP_DEADLINE")
+	if s == "" {
+		return nil, nil
+	}
+	deadline, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid EASYWED_RSVP_DEADLINE: %s", err)
+	}
+	return &deadline, nil
+}
+
+// checkRSVPOpen refuses the answers of g after the deadline. For an event the
+// deadline is its own one when set, the global one otherwise. Without an event
+// the whole RSVP is answered: the global deadline and the ones of every invitation apply
+func checkRSVPOpen(ctx context.Context, db Store, g Guest, eventID *primitive.ObjectID) error {
+	global, err := getRSVPDeadline()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	closed := func(e Event) bool {
+		deadline := e.RSVPDeadline
+		if deadline == nil {
+			deadline = global
+		}
+		return deadline != nil && now.After(*deadline)
+	}
+
+	if eventID != nil {
+		e, err := db.ReadEvent(ctx, *eventID)
+		if err != nil {
+			return err
+		}
+		if closed(e) {
+			return ErrRSVPClosed
+		}
+		return nil
+	}
+
+	if global != nil && now.After(*global) {
+		return ErrRSVPClosed
+	}
+	for _, inv := range g.Events {
+		e, err := db.ReadEvent(ctx, inv.EventID)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if closed(e) {
+			return ErrRSVPClosed
+		}
+	}
+	return nil
+}
+
 func extractToken(r *http.Request) (*jwt.Token, string, error) {
 	var tokenString string
 
@@ -46,37 +110,55 @@ func extractToken(r *http.Request) (*jwt.Token, string, error) {
 	// If the token is empty...
 	if tokenString == "" {
 		// If we get here, the required token is missing
-		return nil, "", errors.New("Missing auth token")
+		return nil, "", unauthorized("Missing auth token")
 	}
-	token, err := jwt.Parse(tokenString, func(tok *jwt.Token) (interface{}, error) {
+	token, err := parseJWT(tokenString, secret)
+	if err != nil {
+		return nil, "", tokenError(err)
+	}
+	return token, tokenString, nil
+}
+
+// tokenError tells the expired tokens, to refresh, from the invalid ones
+func tokenError(err error) *APIError {
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+		return newAPIError(http.StatusUnauthorized, CodeTokenExpired, "Token expired")
+	}
+	return unauthorized("Invalid token")
+}
+
+// parseJWT checks the signature and the expiration of a token
+func parseJWT(tokenString, secret string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(tok *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
 		if _, ok := tok.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", tok.Header["alg"])
 		}
 		return []byte(secret), nil
 	})
-
-	if err != nil {
-		return nil, "", err
-	}
-	return token, tokenString, nil
 }
 
-func validateTokenForAPI(token string, APICode int, db *DataBridge) error {
+func validateTokenForAPI(ctx context.Context, token string, perm Permission, db Store) error {
 	// Get the Auth Object from the db
-	auth, err := db.ReadAuth(token)
+	auth, err := db.ReadAuth(ctx, token)
+	if err == ErrNotFound {
+		return unauthorized("Unknown token")
+	}
 	if err != nil {
 		return err
 	}
-	if !checkAuthCode(APICode, auth.AuthCode) {
-		log.Println("1")
-		log.Printf("APICode:%d authCode:%d", APICode, auth.AuthCode)
-		return errors.New("User is not authorized")
+	// Refuse revoked and expired tokens
+	if err = checkAuthUsable(auth, authKindAccess); err != nil {
+		return err
+	}
+	if !roleHasPermission(auth.Role, perm) {
+		log.Printf("Permission:%s role:%s", perm, auth.Role)
+		return forbidden("User is not authorized")
 	}
 	return nil
 }
 
-func validateRequestAPIReadGuest(r *http.Request, db *DataBridge) error {
+func validateRequestAPIReadGuest(r *http.Request, db Store) error {
 	// Extract token
 	token, tokenString, err := extractToken(r)
 	if err != nil {
@@ -85,10 +167,10 @@ func validateRequestAPIReadGuest(r *http.Request, db *DataBridge) error {
 	claims, ok := token.Claims.(jwt.MapClaims)
 
 	if !ok || !token.Valid {
-		return errors.New("Not valid Token")
+		return unauthorized("Not valid Token")
 	}
 	// Compare the user rights
-	if err = validateTokenForAPI(tokenString, APIReadGuest, db); err != nil {
+	if err = validateTokenForAPI(r.Context(), tokenString, PermReadGuest, db); err != nil {
 		return err
 	}
 
@@ -96,57 +178,39 @@ func validateRequestAPIReadGuest(r *http.Request, db *DataBridge) error {
 	un, ok := mux.Vars(r)["user_name"]
 
 	if !ok {
-		return errors.New("No username provided")
+		return badRequest(errors.New("No username provided"))
 	}
 
 	// Compare the user of the request with the user of the token
 	user, ok := claims["user"]
 	if !ok {
-		return errors.New("No user claim found in token")
+		return unauthorized("No user claim found in token")
 	}
 	if user != un {
 		log.Println("2")
-		return errors.New("User is not authorized")
+		return forbidden("User is not authorized")
 	}
 	return nil
 }
 
-func validateRequestAPIReadGuestAll(r *http.Request, db *DataBridge) error {
-	// Extract token
-	token, tokenString, err := extractToken(r)
-	if err != nil {
-		return err
-	}
-
-	if !token.Valid {
-		return errors.New("Not valid Token")
-	}
-	// Compare the user rights
-	if err = validateTokenForAPI(tokenString, APIReadAll, db); err != nil {
-		return err
-	}
-	return nil
-}
-
-func validateRequestAPICreateGuest(r *http.Request, db *DataBridge) error {
-	// Extract token
-	token, tokenString, err := extractToken(r)
-	if err != nil {
-		return err
-	}
+// validateRequestPermission only checks that the token grants perm
+func validateRequestPermission(perm Permission) func(r *http.Request, db Store) error {
+	return func(r *http.Request, db Store) error {
+		// Extract token
+		token, tokenString, err := extractToken(r)
+		if err != nil {
+			return err
+		}
 
-	if !token.Valid {
-		return errors.New("Not valid Token")
-	}
-	// Compare the user rights
-	if err = validateTokenForAPI(tokenString, APICreateGuest, db); err != nil {
-		return err
+		if !token.Valid {
+			return unauthorized("Not valid Token")
+		}
+		// Compare the user rights
+		return validateTokenForAPI(r.Context(), tokenString, perm, db)
 	}
-
-	return nil
 }
 
-func validateRequestAPIUpdateGuest(r *http.Request, db *DataBridge) error {
+func validateRequestAPIUpdateGuest(r *http.Request, db Store) error {
 	// Extract token
 	token, tokenString, err := extractToken(r)
 	if err != nil {
@@ -155,10 +219,10 @@ func validateRequestAPIUpdateGuest(r *http.Request, db *DataBridge) error {
 	claims, ok := token.Claims.(jwt.MapClaims)
 
 	if !ok || !token.Valid {
-		return errors.New("Not valid Token")
+		return unauthorized("Not valid Token")
 	}
 	// Compare the user rights
-	if err = validateTokenForAPI(tokenString, APIUpdateGuest, db); err != nil {
+	if err = validateTokenForAPI(r.Context(), tokenString, PermUpdateGuest, db); err != nil {
 		return err
 	}
 
@@ -166,7 +230,7 @@ func validateRequestAPIUpdateGuest(r *http.Request, db *DataBridge) error {
 	id, ok := mux.Vars(r)["id"]
 
 	if !ok {
-		return errors.New("No username provided")
+		return badRequest(errors.New("No username provided"))
 	}
 
 	// Unmarshal the body request: can't use directly, otherwise we will incurr
@@ -179,38 +243,133 @@ func validateRequestAPIUpdateGuest(r *http.Request, db *DataBridge) error {
 	}
 	br := bytes.NewReader(bytesBody)
 
-	if err := json.NewDecoder(br).Decode(&g); err != nil {
-		return err
+	if err := decodeStrict(br, &g); err != nil {
+		return badRequest(err)
 	}
 
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(bytesBody))
 
 	// first compare the id of the body with the id from the URI
 	if id != g.ID.Hex() {
-		return errors.New("User not authorized")
+		return forbidden("User not authorized")
 	}
 
 	// Compare the user of the request with the user of the token
 	idToken, ok := claims["id"]
 	if !ok {
-		return errors.New("No id claim found in token")
+		return unauthorized("No id claim found in token")
 	}
 	if id != idToken {
-		return errors.New("User is not authorized")
+		return forbidden("User is not authorized")
+	}
+
+	// After the deadline the guest sends a change request instead
+	stored, err := db.ReadGuestByID(r.Context(), g.ID)
+	if err != nil {
+		return err
+	}
+	return checkRSVPOpen(r.Context(), db, stored, nil)
+}
+
+// validateRSVP checks the per member answers of an RSVP: each member answers
+// once, and the names out of the household are companions, up to the
+// plus-ones of the invitation. Without members the answer is for the whole household
+func validateRSVP(stored Guest, rsvp Guest) error {
+	if err := validateMembers(rsvp.Members); err != nil {
+		return err
+	}
+	companions := 0
+	for _, m := range rsvp.Members {
+		if !stored.isHousehold(m.Name) {
+			companions++
+		}
+	}
+	if companions > stored.PlusOnes {
+		return fmt.Errorf("The invitation allows %d companions, %d given", stored.PlusOnes, companions)
 	}
 	return nil
 }
 
-func newValidator(r *http.Request, db *DataBridge, APICode int) func(r *http.Request, db *DataBridge) error {
-	switch APICode {
-	case APIReadGuest:
+// validateEventAnswer returns the attendees of an event answer: members of the
+// household, or all of them with attending. A guest without members comes alone
+func validateEventAnswer(g Guest, answer EventAnswer) ([]string, error) {
+	names := []string{}
+	for _, m := range g.Members {
+		names = append(names, m.Name)
+	}
+	if len(names) == 0 {
+		names = append(names, g.UserName)
+	}
+
+	switch {
+	case answer.Attendees != nil:
+		attendees := []string{}
+		for _, a := range *answer.Attendees {
+			i := -1
+			for j, n := range names {
+				if strings.EqualFold(strings.TrimSpace(a), n) {
+					i = j
+				}
+			}
+			if i < 0 {
+				return nil, fmt.Errorf("%s is not a member of the household", a)
+			}
+			if findName(attendees, names[i]) {
+				return nil, fmt.Errorf("%s listed twice", a)
+			}
+			attendees = append(attendees, names[i])
+		}
+		return attendees, nil
+	case answer.Attending != nil:
+		if *answer.Attending {
+			return names, nil
+		}
+		return []string{}, nil
+	}
+	return nil, errors.New("attendees or attending is required")
+}
+
+// validateRequestOwnGuest checks that the token grants perm and belongs
+// to the guest of the request URI
+func validateRequestOwnGuest(perm Permission) func(r *http.Request, db Store) error {
+	return func(r *http.Request, db Store) error {
+		// Extract token
+		token, tokenString, err := extractToken(r)
+		if err != nil {
+			return err
+		}
+		claims, ok := token.Claims.(jwt.MapClaims)
+
+		if !ok || !token.Valid {
+			return unauthorized("Not valid Token")
+		}
+		// Compare the user rights
+		if err = validateTokenForAPI(r.Context(), tokenString, perm, db); err != nil {
+			return err
+		}
+
+		// Compare the guest of the request with the one of the token
+		id, ok := mux.Vars(r)["id"]
+		if !ok {
+			return badRequest(errors.New("No Guest Id"))
+		}
+		if idToken, ok := claims["id"]; !ok || idToken != id {
+			return forbidden("User is not authorized")
+		}
+		return nil
+	}
+}
+
+// newValidator returns the validation of a permission: the guest ones
+// also check that the token belongs to the guest of the request
+func newValidator(r *http.Request, db Store, perm Permission) func(r *http.Request, db Store) error {
+	switch perm {
+	case PermReadGuest:
 		return validateRequestAPIReadGuest
-	case APIReadAll:
-		return validateRequestAPIReadGuestAll
-	case APICreateGuest:
-		return validateRequestAPICreateGuest
-	case APIUpdateGuest:
+	case PermUpdateGuest:
 		return validateRequestAPIUpdateGuest
+	case PermAnswerEvent, PermRequestChange:
+		return validateRequestOwnGuest(perm)
 	}
-	return func(r *http.Request, db *DataBridge) error { return nil }
+	return validateRequestPermission(perm)
 }
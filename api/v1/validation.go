@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// shortest password of a new guest
+	minPasswordLength = 8
+	// bcrypt ignores what comes after
+	maxPasswordBytes = 72
+	// biggest household, companions included
+	maxMembers = 30
+	// longest reason of a change request, in characters
+	maxReasonLength = 1000
+	// longest username, made of letters only
+	maxUserNameLength = 64
+)
+
+// isoCountries are the ISO 3166-1 alpha-2 codes
+var isoCountries = strings.Fields("" +
+	"AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE " +
+	"BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ CA CC CD " +
+	"CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM " +
+	"DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR GA GB GD GE GF " +
+	"GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU " +
+	"ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN " +
+	"KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME " +
+	"MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ NA " +
+	"NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM " +
+	"PN PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI " +
+	"SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK " +
+	"TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI " +
+	"VN VU WF WS YE YT ZA ZM ZW")
+
+// commonPasswords are refused whatever their length
+var commonPasswords = []string{"password", "12345678", "123456789", "qwertyuiop", "azertyuiop", "iloveyou", "wedding"}
+
+// guestText is a text field of a guest and its longest length, in characters
+type guestText struct {
+	field string
+	max   int
+	value func(g *Guest) *string
+}
+
+// guestTexts are the limits of the text fields of a guest
+var guestTexts = []guestText{
+	{"user_name", maxUserNameLength, func(g *Guest) *string { return &g.UserName }},
+	{"invitees", 300, func(g *Guest) *string { return &g.Invitees }},
+	{"modification", 2000, func(g *Guest) *string { return &g.Modification }},
+	{"food_requirements", 1000, func(g *Guest) *string { return &g.FoodRequirements }},
+	{"email", 254, func(g *Guest) *string { return &g.Email }},
+}
+
+// fieldErrors collects the errors of the fields of a body
+type fieldErrors []FieldError
+
+func (fe *fieldErrors) add(field string, err error) {
+	*fe = append(*fe, FieldError{Field: field, Message: err.Error()})
+}
+
+// err returns the errors in one APIError, nil when there is none
+func (fe fieldErrors) err() error {
+	if len(fe) == 0 {
+		return nil
+	}
+	e := newAPIError(http.StatusBadRequest, CodeInvalidField, fe[0].Message)
+	if len(fe) > 1 {
+		e.Message = fmt.Sprintf("%s, and %d more invalid fields", fe[0].Message, len(fe)-1)
+	}
+	e.Field = fe[0].Field
+	e.Errors = fe
+	return e
+}
+
+// decodeStrict decodes a JSON body, refusing the unknown fields
+func decodeStrict(body io.Reader, v interface{}) error {
+	d := json.NewDecoder(body)
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+// validateCountry accepts an ISO 3166-1 alpha-2 code
+func validateCountry(country string) error {
+	for _, c := range isoCountries {
+		if country == c {
+			return nil
+		}
+	}
+	return errors.New("country must be an ISO 3166-1 alpha-2 code, as IT")
+}
+
+// validateLanguage accepts the codes of the languages with templates
+func validateLanguage(language string) error {
+	if _, ok := sitePages[strings.ToLower(language)]; !ok {
+		return errors.New("language must be EN, FR or IT")
+	}
+	return nil
+}
+
+// validatePassword checks the strength of the password of a new guest
+func validatePassword(password, userName string) error {
+	first, _ := utf8.DecodeRuneInString(password)
+	switch {
+	case utf8.RuneCountInString(password) < minPasswordLength:
+		return fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	case len(password) > maxPasswordBytes:
+		return fmt.Errorf("password must have at most %d bytes", maxPasswordBytes)
+	case userName != "" && strings.Contains(strings.ToLower(password), strings.ToLower(userName)):
+		return errors.New("password can't contain the username")
+	case strings.IndexFunc(password, func(r rune) bool { return r != first }) < 0:
+		return errors.New("password can't repeat a single character")
+	}
+	for _, p := range commonPasswords {
+		if strings.EqualFold(password, p) {
+			return errors.New("password is too common")
+		}
+	}
+	return nil
+}
+
+// guestCodes are the fields of a guest holding a code, and their check
+var guestCodes = []struct {
+	field    string
+	value    func(g *Guest) *string
+	validate func(string) error
+}{
+	{"country", func(g *Guest) *string { return &g.Country }, validateCountry},
+	{"language", func(g *Guest) *string { return &g.Language }, validateLanguage},
+}
+
+// checkGuestFields checks the fields of g changed from stored, all of them
+// when stored is nil: the values stored before the validation are kept.
+// The codes changed are set in upper case
+func checkGuestFields(fe *fieldErrors, g *Guest, stored *Guest) {
+	for _, t := range guestTexts {
+		if stored != nil && *t.value(g) == *t.value(stored) {
+			continue
+		}
+		if utf8.RuneCountInString(*t.value(g)) > t.max {
+			fe.add(t.field, fmt.Errorf("%s must have at most %d characters", t.field, t.max))
+		}
+	}
+	for _, c := range guestCodes {
+		code := c.value(g)
+		if stored != nil && strings.EqualFold(strings.TrimSpace(*code), *c.value(stored)) {
+			continue
+		}
+		if *code = strings.ToUpper(strings.TrimSpace(*code)); *code == "" {
+			continue
+		}
+		if err := c.validate(*code); err != nil {
+			fe.add(c.field, err)
+		}
+	}
+	if stored == nil || g.Email != stored.Email {
+		if err := validateEmail(g.Email); err != nil {
+			fe.add("email", err)
+		}
+	}
+	if g.PlusOnes < 0 {
+		fe.add("plus_ones", errors.New("plus_ones can't be negative"))
+	}
+
+	if len(g.Members) > maxMembers {
+		fe.add("members", fmt.Errorf("A household has at most %d members", maxMembers))
+	}
+	for i, m := range g.Members {
+		field := fmt.Sprintf("members[%d]", i)
+		if utf8.RuneCountInString(m.Name) > 100 {
+			fe.add(field+".name", errors.New("name must have at most 100 characters"))
+		}
+		if utf8.RuneCountInString(m.FoodRequirements) > 1000 {
+			fe.add(field+".food_requirements", errors.New("food_requirements must have at most 1000 characters"))
+		}
+	}
+	if err := validateMembers(g.Members); err != nil {
+		fe.add("members", err)
+	}
+}
+
+// validateNewGuest checks a guest to create. Without passwordRequired an
+// empty password is accepted, as the import generates it
+func validateNewGuest(g *Guest, passwordRequired bool) error {
+	var fe fieldErrors
+	if !sanitizeUserName(g.UserName) {
+		fe.add("user_name", errors.New("username must be made of letters only"))
+	}
+	if g.Password != "" || passwordRequired {
+		if err := validatePassword(g.Password, g.UserName); err != nil {
+			fe.add("password", err)
+		}
+	}
+	checkGuestFields(&fe, g, nil)
+	return fe.err()
+}
+
+// validateGuestUpdate checks the fields of g changed from stored
+func validateGuestUpdate(g *Guest, stored Guest) error {
+	var fe fieldErrors
+	checkGuestFields(&fe, g, &stored)
+	return fe.err()
+}
+
+// validateChange checks the reason of a change request and the guest its RSVP
+// would give: when the request is made, and again when it is approved
+func validateChange(c ChangeRequest, stored Guest) error {
+	var fe fieldErrors
+	if utf8.RuneCountInString(c.Reason) > maxReasonLength {
+		fe.add("reason", fmt.Errorf("reason must have at most %d characters", maxReasonLength))
+	}
+	rsvp := c.RSVP.guest()
+	if err := validateRSVP(stored, rsvp); err != nil {
+		fe.add("rsvp.members", err)
+		return fe.err()
+	}
+
+	next := stored.clone()
+	next.answerRSVP(rsvp)
+	var rsvpErrs fieldErrors
+	checkGuestFields(&rsvpErrs, &next, &stored)
+	for _, e := range rsvpErrs {
+		e.Field = "rsvp." + e.Field
+		fe = append(fe, e)
+	}
+	return fe.err()
+}
@@ -352,17 +352,60 @@
 	}
 
 
+	// storeIdentity keeps the tokens of the guest logged in
+	function storeIdentity(response) {
+		localStorage.setItem("dummies_mariage_user",response.user_name)
+		localStorage.setItem("dummies_mariage_id",response.id)
+		localStorage.setItem("dummies_mariage_jwt",response.jwt_token)
+		localStorage.setItem("dummies_mariage_refresh",response.refresh_token)
+	}
+
+	// clearIdentity forgets the guest and shows the login again
+	function clearIdentity() {
+		localStorage.removeItem("dummies_mariage_user")
+		localStorage.removeItem("dummies_mariage_id")
+		localStorage.removeItem("dummies_mariage_jwt")
+		localStorage.removeItem("dummies_mariage_refresh")
+		location.reload(true)
+	}
+
+	// authAjax sends an authenticated call. When the token has expired, it is
+	// refreshed once and the call sent again; if the refresh fails, the guest
+	// has to log in again
+	function authAjax(options) {
+		var send = function() {
+			options.headers = {
+				"Authorization": "Bearer " + localStorage.getItem('dummies_mariage_jwt'),
+				"Accept": "text/json"
+			}
+			return $.ajax(options)
+		}
+		var result = $.Deferred()
+		send().done(result.resolve).fail(function(jqXHR, textStatus, errorThrown) {
+			if (apiError(jqXHR).code !== "token_expired") {
+				result.reject(jqXHR, textStatus, errorThrown)
+				return
+			}
+			$.ajax({
+				type: 'POST',
+				url: "https://www.easyWedCL.tk/api/auth/refresh",
+				data: JSON.stringify({ refresh_token: localStorage.getItem('dummies_mariage_refresh') })
+			}).done(function(response) {
+				storeIdentity(response)
+				send().done(result.resolve).fail(result.reject)
+			}).fail(function() {
+				result.reject(jqXHR, textStatus, errorThrown)
+				clearIdentity()
+			})
+		})
+		return result.promise()
+	}
+
 	function callGetGuests() {
 		// if we are at this point the jwt token is known
 		var user = localStorage.getItem('dummies_mariage_user')
-		var token = localStorage.getItem('dummies_mariage_jwt')
-		var id = localStorage.getItem('dummies_mariage_id')
-		$.ajax({
+		authAjax({
 			type: 'GET',
-			headers: {
-				"Authorization": "Bearer " + token,
-				"Accept": "text/json"
-			},
 			//dataType: 'jsonp',
 			url: "https://www.easywedcl.tk/api/guests?user_name=" + user  , // reverse proxy from nginx
 		}).done(function(response) {
@@ -421,6 +464,15 @@
 		return JSON.stringify(obj);
 	};
 
+	// apiError returns the error envelope of a failed call; none when the API can't be reached
+	var apiError = function(jqXHR) {
+		var body = jqXHR.responseJSON;
+		if (body && body.error) {
+			return body.error;
+		}
+		return { code: "unavailable", message: "The service is not available, retry later" };
+	};
+
 	var submitGuestRsvp = function(){
 		// using jQuery because it is used everywhere else in this template
 		var form = $("#guest_rsvp");
@@ -429,14 +481,9 @@
 			var json = toJSONString(this);
 			console.log("Sending");
 			// if we are at this point the jwt token is known
-			var token = localStorage.getItem('dummies_mariage_jwt')
 			var id = localStorage.getItem('dummies_mariage_id')
-			$.ajax({
+			authAjax({
 				type: 'PUT',
-				headers: {
-					"Authorization": "Bearer " + token,
-					"Accept": "text/json"
-				},
 				//dataType: 'jsonp',
 				url: "https://www.easyWedCL.tk/api/guests/" + id  , // reverse proxy from nginx
 				data: json
@@ -453,8 +500,8 @@
 					alert("Thanks for having confirmed your RSVP");
 				}
 
-			}).fail(function(response,textStatus,errorThrown) {
-				alert(jqXHR.responseText)
+			}).fail(function(jqXHR, textStatus, errorThrown) {
+				alert(apiError(jqXHR).message)
 			})
 
 		});
@@ -473,12 +520,21 @@
 				data: json
 			}).done(function(response) {
 				//Sets value in local storage
-				localStorage.setItem("dummies_mariage_user",response.user_name)
-				localStorage.setItem("dummies_mariage_id",response.id)
-				localStorage.setItem("dummies_mariage_jwt",response.jwt_token)
+				storeIdentity(response)
 				location.reload(true)
 			}).fail(function(jqXHR, textStatus, errorThrown) {
-				alert("Log In error")
+				var error = apiError(jqXHR);
+				switch (error.code) {
+					case "wrong_password":
+					case "unknown_user":
+					alert("Log In error: wrong user name or password");
+					break;
+					case "login_blocked":
+					alert("Too many failed attempts, retry in " + jqXHR.getResponseHeader("Retry-After") + " seconds");
+					break;
+					default:
+					alert("Log In error: " + error.message);
+				}
 			})
 		});
 	};
@@ -1 +1 @@
-!function(){"use strict";var n={Android:function(){return navigator.userAgent.match(/Android/i)},BlackBerry:function(){return navigator.userAgent.match(/BlackBerry/i)},iOS:function(){return navigator.userAgent.match(/iPhone|iPad|iPod/i)},Opera:function(){return navigator.userAgent.match(/Opera Mini/i)},Windows:function(){return navigator.userAgent.match(/IEMobile/i)},any:function(){return n.Android()||n.BlackBerry()||n.iOS()||n.Opera()||n.Windows()}},a=function(e){var a=$(".navbar-nav");a.find("li").removeClass("active"),a.each(function(){$(this).find('a[data-nav-section="'+e+'"]').closest("li").addClass("active")})};function i(e){return!!$("#"+e).is(":checked")}function t(e,a){e?$("#"+a).attr("checked",!0):$("#"+a).attr("checked",!1)}var e=function(){var e,a;localStorage.getItem("dummies_mariage_user")&&localStorage.getItem("dummies_mariage_id")&&localStorage.getItem("dummies_mariage_jwt")?($("#auth").toggle(),console.log("call get guest"),e=localStorage.getItem("dummies_mariage_user"),a=localStorage.getItem("dummies_mariage_jwt"),localStorage.getItem("dummies_mariage_id"),$.ajax({type:"GET",headers:{Authorization:"Bearer "+a,Accept:"text/json"},url:"https://www.easywedcl.tk/api/guests?user_name="+e}).done(function(e){$("#invitees").val(e.invitees),$("#invitees").attr("disabled",!0),$("#modification").val(e.modification),$("#food-requirements").val(e.food_requirements),t(e.needs_accomodation,"needs_accomodation"),t(e.needs_passage,"needs_passage"),t(e.confirmed,"presence-yes")})):(console.log("toggle rsvp"),$("#rsvp").toggle())};document.addEventListener("DOMContentLoaded",function(){var e=$("#guest_rsvp");$(e).submit(function(e){e.preventDefault();var a,t=((a={}).invitees=$("#invitees").val(),a.modification=$("#modification").val(),a.food_requirements=$("#food-requirements").val(),a.needs_accomodation=i("needs_accomodation"),a.needs_passage=i("needs_passage"),a.confirmed=i("presence-yes"),a.user_name=localStorage.getItem("dummies_mariage_user"),a.id=localStorage.getItem("dummies_mariage_id"),JSON.stringify(a));console.log("Sending");var n=localStorage.getItem("dummies_mariage_jwt"),o=localStorage.getItem("dummies_mariage_id");$.ajax({type:"PUT",headers:{Authorization:"Bearer "+n,Accept:"text/json"},url:"https://www.easyWedCL.tk/api/guests/"+o,data:t}).done(function(e){switch(console.log(e),e.language){case"IT":alert("Grazie per aver confermato l'RSVP");break;case"FR":alert("Merci d'avoir confirmé votre RSVP");break;default:alert("Thanks for having confirmed your RSVP")}}).fail(function(e,a,t){alert(jqXHR.responseText)})})});document.addEventListener("DOMContentLoaded",function(){var e=$("#login");$(e).submit(function(e){e.preventDefault();var a,t=((a={}).user_name=$("#user_name_auth").val(),a.password=$("#password_auth").val(),JSON.stringify(a));$.ajax({type:"POST",url:"https://www.easyWedCL.tk/api/auth",data:t}).done(function(e){localStorage.setItem("dummies_mariage_user",e.user_name),localStorage.setItem("dummies_mariage_id",e.id),localStorage.setItem("dummies_mariage_jwt",e.jwt_token),location.reload(!0)}).fail(function(e,a,t){alert("Log In error")})})}),$(function(){var t,e;$(".probootstrap-animate").waypoint(function(e){"down"!==e||$(this.element).hasClass("probootstrap-animated")||($(this.element).addClass("item-animate"),setTimeout(function(){$("body .probootstrap-animate.item-animate").each(function(e){var a=$(this);setTimeout(function(){var e=a.data("animate-effect");"fadeIn"===e?a.addClass("fadeIn probootstrap-animated"):"fadeInLeft"===e?a.addClass("fadeInLeft probootstrap-animated"):"fadeInRight"===e?a.addClass("fadeInRight probootstrap-animated"):a.addClass("fadeInUp probootstrap-animated"),a.removeClass("item-animate")},30*e,"easeInOutExpo")})},100))},{offset:"95%"}),t=0,$(window).scroll(function(){var e=$(this).scrollTop(),a=$(".probootstrap-navbar");400<e?a.addClass("scrolled"):a.removeClass("scrolled"),t<e?a.hasClass("scrolled")&&a.removeClass("awake"):a.hasClass("scrolled")&&a.addClass("awake"),t=e}),n.any()||$(window).stellar(),$('.navbar-nav a:not([class="external"])').click(function(e){var a=$(this).data("nav-section");return $(".navbar-nav"),n.any()&&$(".navbar-toggle").click(),$('[data-section="'+a+'"]').length&&$("html, body").animate({scrollTop:$('[data-section="'+a+'"]').offset().top},500,"easeInOutExpo"),e.preventDefault(),!1}),(e=$("section[data-section]")).waypoint(function(e){"down"===e&&a($(this.element).data("section"))},{offset:"150px"}),e.waypoint(function(e){"up"===e&&a($(this.element).data("section"))},{offset:function(){return-$(this.element).height()-155}}),$(".date-countdown").simplyCountdown({year:2019,month:9,day:21,hours:14,minutes:30,seconds:0}),$(".image-popup").magnificPopup({type:"image",removalDelay:300,mainClass:"mfp-with-zoom",gallery:{enabled:!0},zoom:{enabled:!0,duration:300,easing:"ease-in-out",opener:function(e){return e.is("img")?e:e.find("img")}}}),$(".with-caption").magnificPopup({type:"image",closeOnContentClick:!0,closeBtnInside:!1,mainClass:"mfp-with-zoom mfp-img-mobile",image:{verticalFit:!0,titleSrc:function(e){return e.el.attr("title")+' &middot; <a class="image-source-link" href="'+e.el.attr("data-source")+'" target="_blank">image source</a>'}},zoom:{enabled:!0}}),$(".popup-youtube, .popup-vimeo, .popup-gmaps").magnificPopup({disableOn:700,type:"iframe",mainClass:"mfp-fade",removalDelay:160,preloader:!1,fixedContentPos:!1})}),$(window).load(function(){$(".flexslider").flexslider({animation:"fade",prevText:"",nextText:"",animationSpeed:1e3,slideshow:!0,controlNav:!1,animationLoop:!0,directionNav:!1})}),$(window).ready(function(){console.log("ready"),e()})}();
\ No newline at end of file
+!function(){"use strict";var n={Android:function(){return navigator.userAgent.match(/Android/i)},BlackBerry:function(){return navigator.userAgent.match(/BlackBerry/i)},iOS:function(){return navigator.userAgent.match(/iPhone|iPad|iPod/i)},Opera:function(){return navigator.userAgent.match(/Opera Mini/i)},Windows:function(){return navigator.userAgent.match(/IEMobile/i)},any:function(){return n.Android()||n.BlackBerry()||n.iOS()||n.Opera()||n.Windows()}},a=function(e){var a=$(".navbar-nav");a.find("li").removeClass("active"),a.each(function(){$(this).find('a[data-nav-section="'+e+'"]').closest("li").addClass("active")})};function i(e){return!!$("#"+e).is(":checked")}function t(e,a){e?$("#"+a).attr("checked",!0):$("#"+a).attr("checked",!1)}function r(e){localStorage.setItem("dummies_mariage_user",e.user_name),localStorage.setItem("dummies_mariage_id",e.id),localStorage.setItem("dummies_mariage_jwt",e.jwt_token),localStorage.setItem("dummies_mariage_refresh",e.refresh_token)}function s(){localStorage.removeItem("dummies_mariage_user"),localStorage.removeItem("dummies_mariage_id"),localStorage.removeItem("dummies_mariage_jwt"),localStorage.removeItem("dummies_mariage_refresh"),location.reload(!0)}function o(e){return e.responseJSON&&e.responseJSON.error?e.responseJSON.error:{code:"unavailable",message:"The service is not available, retry later"}}function l(a){var t=function(){return a.headers={Authorization:"Bearer "+localStorage.getItem("dummies_mariage_jwt"),Accept:"text/json"},$.ajax(a)},n=$.Deferred();return t().done(n.resolve).fail(function(e,a,i){"token_expired"===o(e).code?$.ajax({type:"POST",url:"https://www.easyWedCL.tk/api/auth/refresh",data:JSON.stringify({refresh_token:localStorage.getItem("dummies_mariage_refresh")})}).done(function(e){r(e),t().done(n.resolve).fail(n.reject)}).fail(function(){n.reject(e,a,i),s()}):n.reject(e,a,i)}),n.promise()}var e=function(){var e;localStorage.getItem("dummies_mariage_user")&&localStorage.getItem("dummies_mariage_id")&&localStorage.getItem("dummies_mariage_jwt")?($("#auth").toggle(),console.log("call get guest"),e=localStorage.getItem("dummies_mariage_user"),l({type:"GET",url:"https://www.easywedcl.tk/api/guests?user_name="+e}).done(function(e){$("#invitees").val(e.invitees),$("#invitees").attr("disabled",!0),$("#modification").val(e.modification),$("#food-requirements").val(e.food_requirements),t(e.needs_accomodation,"needs_accomodation"),t(e.needs_passage,"needs_passage"),t(e.confirmed,"presence-yes")})):(console.log("toggle rsvp"),$("#rsvp").toggle())};document.addEventListener("DOMContentLoaded",function(){var e=$("#guest_rsvp");$(e).submit(function(e){e.preventDefault();var a,t=((a={}).invitees=$("#invitees").val(),a.modification=$("#modification").val(),a.food_requirements=$("#food-requirements").val(),a.needs_accomodation=i("needs_accomodation"),a.needs_passage=i("needs_passage"),a.confirmed=i("presence-yes"),a.user_name=localStorage.getItem("dummies_mariage_user"),a.id=localStorage.getItem("dummies_mariage_id"),JSON.stringify(a));console.log("Sending");var n=localStorage.getItem("dummies_mariage_id");l({type:"PUT",url:"https://www.easyWedCL.tk/api/guests/"+n,data:t}).done(function(e){switch(console.log(e),e.language){case"IT":alert("Grazie per aver confermato l'RSVP");break;case"FR":alert("Merci d'avoir confirmé votre RSVP");break;default:alert("Thanks for having confirmed your RSVP")}}).fail(function(e,a,t){alert(o(e).message)})})});document.addEventListener("DOMContentLoaded",function(){var e=$("#login");$(e).submit(function(e){e.preventDefault();var a,t=((a={}).user_name=$("#user_name_auth").val(),a.password=$("#password_auth").val(),JSON.stringify(a));$.ajax({type:"POST",url:"https://www.easyWedCL.tk/api/auth",data:t}).done(function(e){r(e),location.reload(!0)}).fail(function(e,a,t){var n=o(e);switch(n.code){case"wrong_password":case"unknown_user":alert("Log In error: wrong user name or password");break;case"login_blocked":alert("Too many failed attempts, retry in "+e.getResponseHeader("Retry-After")+" seconds");break;default:alert("Log In error: "+n.message)}})})}),$(function(){var t,e;$(".probootstrap-animate").waypoint(function(e){"down"!==e||$(this.element).hasClass("probootstrap-animated")||($(this.element).addClass("item-animate"),setTimeout(function(){$("body .probootstrap-animate.item-animate").each(function(e){var a=$(this);setTimeout(function(){var e=a.data("animate-effect");"fadeIn"===e?a.addClass("fadeIn probootstrap-animated"):"fadeInLeft"===e?a.addClass("fadeInLeft probootstrap-animated"):"fadeInRight"===e?a.addClass("fadeInRight probootstrap-animated"):a.addClass("fadeInUp probootstrap-animated"),a.removeClass("item-animate")},30*e,"easeInOutExpo")})},100))},{offset:"95%"}),t=0,$(window).scroll(function(){var e=$(this).scrollTop(),a=$(".probootstrap-navbar");400<e?a.addClass("scrolled"):a.removeClass("scrolled"),t<e?a.hasClass("scrolled")&&a.removeClass("awake"):a.hasClass("scrolled")&&a.addClass("awake"),t=e}),n.any()||$(window).stellar(),$('.navbar-nav a:not([class="external"])').click(function(e){var a=$(this).data("nav-section");return $(".navbar-nav"),n.any()&&$(".navbar-toggle").click(),$('[data-section="'+a+'"]').length&&$("html, body").animate({scrollTop:$('[data-section="'+a+'"]').offset().top},500,"easeInOutExpo"),e.preventDefault(),!1}),(e=$("section[data-section]")).waypoint(function(e){"down"===e&&a($(this.element).data("section"))},{offset:"150px"}),e.waypoint(function(e){"up"===e&&a($(this.element).data("section"))},{offset:function(){return-$(this.element).height()-155}}),$(".date-countdown").simplyCountdown({year:2019,month:9,day:21,hours:14,minutes:30,seconds:0}),$(".image-popup").magnificPopup({type:"image",removalDelay:300,mainClass:"mfp-with-zoom",gallery:{enabled:!0},zoom:{enabled:!0,duration:300,easing:"ease-in-out",opener:function(e){return e.is("img")?e:e.find("img")}}}),$(".with-caption").magnificPopup({type:"image",closeOnContentClick:!0,closeBtnInside:!1,mainClass:"mfp-with-zoom mfp-img-mobile",image:{verticalFit:!0,titleSrc:function(e){return e.el.attr("title")+' &middot; <a class="image-source-link" href="'+e.el.attr("data-source")+'" target="_blank">image source</a>'}},zoom:{enabled:!0}}),$(".popup-youtube, .popup-vimeo, .popup-gmaps").magnificPopup({disableOn:700,type:"iframe",mainClass:"mfp-fade",removalDelay:160,preloader:!1,fixedContentPos:!1})}),$(window).load(function(){$(".flexslider").flexslider({animation:"fade",prevText:"",nextText:"",animationSpeed:1e3,slideshow:!0,controlNav:!1,animationLoop:!0,directionNav:!1})}),$(window).ready(function(){console.log("ready"),e()})}();
\ No newline at end of file